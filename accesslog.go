@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/betamos/rdv"
+	"github.com/xtaci/smux"
+)
+
+// Close reasons of forwarded conns in the access log.
+const (
+	closeEOF       = "eof"        // Both directions finished
+	closeReset     = "reset"      // Either side was reset, or closed without finishing
+	closeIdle      = "idle"       // No traffic for the tunnel's idle timeout
+	closeLifetime  = "lifetime"   // Open for the tunnel's max lifetime
+	closeSession   = "session"    // The session with the peer died
+	closeError     = "error"      // Any other error
+	closeDenied    = "denied"     // By the source acl or -target-allow
+	closeNoSession = "no_session" // Not connected to the peer, or the stream couldn't be opened
+	closeDial      = "dial"       // The target couldn't be dialed
+)
+
+// An access log entry, written once a forwarded conn has closed. The bytes are counted from the
+// client's point of view: up from the client to the target, down the other way.
+type accessEntry struct {
+	Time      time.Time `json:"time"` // When the conn was accepted
+	Mode      string    `json:"mode"`
+	Tunnel    string    `json:"tunnel"`
+	Session   string    `json:"session"`
+	Client    string    `json:"client"`
+	Listen    string    `json:"listen,omitempty"` // Accept side
+	Target    string    `json:"target,omitempty"` // Dial side
+	Stream    uint32    `json:"stream,omitempty"`
+	IsRelay   bool      `json:"is_relay"`
+	BytesUp   int64     `json:"bytes_up"`
+	BytesDown int64     `json:"bytes_down"`
+	Compress  string    `json:"compress,omitempty"`
+	WireUp    int64     `json:"wire_up,omitempty"`   // Bytes on the stream, if compressed
+	WireDown  int64     `json:"wire_down,omitempty"` // Bytes on the stream, if compressed
+	Duration  int64     `json:"duration_ms"`
+	Close     string    `json:"close"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// accessLog writes json lines to a file, which is reopened upon a reload for log rotation, or to
+// stdout. Nil discards the entries.
+type accessLog struct {
+	mu   sync.Mutex
+	path string
+	w    io.Writer
+	f    *os.File
+}
+
+// The -access-log, nil if disabled.
+var streamLog *accessLog
+
+// Opens the access log, '-' for stdout.
+func openAccessLog(path string) (*accessLog, error) {
+	l := &accessLog{path: path, w: os.Stdout}
+	if path == "-" {
+		return l, nil
+	}
+	return l, l.reopen()
+}
+
+func (l *accessLog) reopen() error {
+	if l == nil || l.path == "-" {
+		return nil
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		l.f.Close()
+	}
+	l.f, l.w = f, f
+	return nil
+}
+
+// Adds the bytes on the stream of a compressed conn, if any, to compare with the bytes before
+// compression. The accept side writes the bytes up to the stream, and the dial side reads them.
+func (e *accessEntry) setWire(cc *compressConn) {
+	if cc == nil {
+		return
+	}
+	e.Compress = compressDeflate
+	out, in := cc.wireOut.Load(), cc.wireIn.Load()
+	if e.Mode == rdv.ACCEPT {
+		e.WireUp, e.WireDown = out, in
+	} else {
+		e.WireUp, e.WireDown = in, out
+	}
+}
+
+// Completes the entry with the duration and the close reason, and writes it.
+func (l *accessLog) log(e *accessEntry, reason string, err error) {
+	if l == nil {
+		return
+	}
+	e.Duration = time.Since(e.Time).Milliseconds()
+	e.Close = reason
+	if err != nil {
+		e.Error = err.Error()
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(append(b, '\n')); err != nil {
+		log.Println("access log:", err)
+	}
+}
+
+// Returns the close reason of a forwarded conn by the error of forward.
+func closeReason(sess *smux.Session, err error) string {
+	switch {
+	case err == nil:
+		return closeEOF
+	case errors.Is(err, errIdle):
+		return closeIdle
+	case errors.Is(err, errLifetime):
+		return closeLifetime
+	case sess.IsClosed():
+		return closeSession
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE), errors.Is(err, io.ErrClosedPipe):
+		return closeReset
+	}
+	return closeError
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/betamos/rdv"
+	"github.com/xtaci/smux"
+)
+
+func TestCloseReason(t *testing.T) {
+	c1, c2 := net.Pipe()
+	live, _ := smux.Client(c1, nil)
+	defer live.Close()
+	defer c2.Close()
+	c3, c4 := net.Pipe()
+	closed, _ := smux.Client(c3, nil)
+	closed.Close()
+	c4.Close()
+
+	for _, c := range []struct {
+		name   string
+		sess   *smux.Session
+		err    error
+		expect string
+	}{
+		{"eof", live, nil, closeEOF},
+		{"idle", live, errIdle, closeIdle},
+		{"idle, wrapped", live, fmt.Errorf("copy: %w", errIdle), closeIdle},
+		{"lifetime", live, errLifetime, closeLifetime},
+		{"deadline", live, &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}, closeError},
+		{"session", closed, io.ErrClosedPipe, closeSession},
+		{"idle of a dead session", closed, errIdle, closeIdle},
+		{"reset", live, &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, closeReset},
+		{"broken pipe", live, &net.OpError{Op: "write", Err: os.NewSyscallError("write", syscall.EPIPE)}, closeReset},
+		{"closed stream", live, io.ErrClosedPipe, closeReset},
+		{"error", live, errors.New("other"), closeError},
+	} {
+		if got := closeReason(c.sess, c.err); got != c.expect {
+			t.Errorf("%s: expected %s, got %s", c.name, c.expect, got)
+		}
+	}
+}
+
+func readEntries(t *testing.T, name string) (entries []accessEntry) {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var e accessEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			t.Fatalf("%s: %v", s.Text(), err)
+		}
+		entries = append(entries, e)
+	}
+	return
+}
+
+func TestAccessLogReopen(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "access.log")
+	l, err := openAccessLog(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.f.Close()
+	l.log(&accessEntry{Time: time.Now(), Mode: rdv.ACCEPT, Tunnel: "first"}, closeEOF, nil)
+
+	// Rotated as by logrotate, which renames the file and then signals a reopen
+	rotated := filepath.Join(dir, "access.log.1")
+	if err := os.Rename(name, rotated); err != nil {
+		t.Fatal(err)
+	}
+	l.log(&accessEntry{Time: time.Now(), Mode: rdv.ACCEPT, Tunnel: "second"}, closeIdle, nil)
+	if err := l.reopen(); err != nil {
+		t.Fatal(err)
+	}
+	l.log(&accessEntry{Time: time.Now(), Mode: rdv.DIAL, Tunnel: "third"}, closeError, errors.New("failed"))
+
+	old, cur := readEntries(t, rotated), readEntries(t, name)
+	if len(old) != 2 || old[0].Tunnel != "first" || old[1].Tunnel != "second" || old[1].Close != closeIdle {
+		t.Errorf("expected the entries before the reopen in the rotated file, got %+v", old)
+	}
+	if len(cur) != 1 || cur[0].Tunnel != "third" || cur[0].Close != closeError || cur[0].Error != "failed" {
+		t.Errorf("expected the entry after the reopen in the new file, got %+v", cur)
+	}
+
+	// Nil and stdout logs ignore reopens
+	var none *accessLog
+	none.log(&accessEntry{}, closeEOF, nil)
+	if err := none.reopen(); err != nil {
+		t.Error(err)
+	}
+	if stdout, err := openAccessLog("-"); err != nil || stdout.reopen() != nil || stdout.f != nil {
+		t.Errorf("expected stdout not to be reopened, got %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+var errTargetDenied = errors.New("target not allowed")
+
+// An acl permits addrs which match an allowed prefix, if any, and no denied prefix.
+type acl struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// Allowed targets of the dial side by -target-allow: addrs, and unix socket paths.
+type targetAllowlist struct {
+	prefixes []netip.Prefix
+	paths    []string
+}
+
+// Allowed targets of the dial side, any if empty.
+var targetAllow targetAllowlist
+
+func (a *acl) permits(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if containsAddr(a.deny, addr) {
+		return false
+	}
+	return len(a.allow) == 0 || containsAddr(a.allow, addr)
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parses CIDRs, or single addrs.
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range list {
+		if addr, err := netip.ParseAddr(s); err == nil {
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR [%s]", s)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Parses CIDRs, single addrs, and unix socket paths with the unix: prefix.
+func parseTargetAllow(list []string) (t targetAllowlist, err error) {
+	var cidrs []string
+	for _, s := range list {
+		if path, ok := strings.CutPrefix(s, unixPrefix); ok {
+			if !filepath.IsAbs(path) {
+				return t, fmt.Errorf("unix socket path [%s] must be absolute", s)
+			}
+			t.paths = append(t.paths, filepath.Clean(path))
+			continue
+		}
+		cidrs = append(cidrs, s)
+	}
+	t.prefixes, err = parsePrefixes(cidrs)
+	return t, err
+}
+
+// Splits a comma-separated flag, skipping empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// Parses the source acl of the tunnel's listeners. The given lists apply unless the tunnel has
+// its own.
+func (t *tunnel) parseACL(allow, deny []string) (err error) {
+	if len(t.Allow) > 0 {
+		allow = t.Allow
+	}
+	if len(t.Deny) > 0 {
+		deny = t.Deny
+	}
+	if t.src.allow, err = parsePrefixes(allow); err != nil {
+		return err
+	}
+	t.src.deny, err = parsePrefixes(deny)
+	return err
+}
+
+// Reports whether the client of an accepted conn may use the tunnel. Unix socket clients aren't
+// subject to the acl, but to the permissions of the socket file.
+func (t *tunnel) permits(c net.Conn) bool {
+	addr, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	return t.src.permits(addr.AddrPort().Addr())
+}
+
+// Rejects dialing a target outside of the targetAllow, checked after name resolution. Used as the
+// net.Dialer Control of targets. Once an allowlist is given, unix sockets must be listed by path,
+// and addrs by CIDR.
+func checkTarget(network, address string, _ syscall.RawConn) error {
+	if len(targetAllow.prefixes) == 0 && len(targetAllow.paths) == 0 {
+		return nil
+	}
+	if strings.HasPrefix(network, "unix") {
+		if !slices.Contains(targetAllow.paths, filepath.Clean(address)) {
+			return errTargetDenied
+		}
+		return nil
+	}
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !containsAddr(targetAllow.prefixes, ap.Addr().Unmap()) {
+		return errTargetDenied
+	}
+	return nil
+}
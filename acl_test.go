@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"testing"
+)
+
+func TestACLPermits(t *testing.T) {
+	for _, c := range []struct {
+		name        string
+		allow, deny []string
+		addr        string
+		expect      bool
+	}{
+		{"empty", nil, nil, "192.0.2.1", true},
+		{"empty ipv6", nil, nil, "2001:db8::1", true},
+		{"allowed", []string{"192.0.2.0/24"}, nil, "192.0.2.1", true},
+		{"not allowed", []string{"192.0.2.0/24"}, nil, "198.51.100.1", false},
+		{"single addr", []string{"192.0.2.1"}, nil, "192.0.2.2", false},
+		{"mapped ipv4", []string{"192.0.2.0/24"}, nil, "::ffff:192.0.2.1", true},
+		{"denied", nil, []string{"192.0.2.0/24"}, "192.0.2.1", false},
+		{"not denied", nil, []string{"192.0.2.0/24"}, "198.51.100.1", true},
+		{"deny wins over allow", []string{"192.0.2.0/24"}, []string{"192.0.2.128/25"}, "192.0.2.200", false},
+		{"allowed outside deny", []string{"192.0.2.0/24"}, []string{"192.0.2.128/25"}, "192.0.2.1", true},
+		{"deny wins over narrower allow", []string{"192.0.2.1"}, []string{"192.0.2.0/24"}, "192.0.2.1", false},
+		{"ipv4 list, ipv6 addr", []string{"192.0.2.0/24"}, nil, "2001:db8::1", false},
+		{"ipv6 allowed", []string{"2001:db8::/32"}, nil, "2001:db8::1", true},
+	} {
+		tun := &tunnel{Allow: c.allow, Deny: c.deny}
+		if err := tun.parseACL(nil, nil); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if got := tun.src.permits(netip.MustParseAddr(c.addr)); got != c.expect {
+			t.Errorf("%s: expected %v for %s, got %v", c.name, c.expect, c.addr, got)
+		}
+	}
+}
+
+// The lists of the tunnel replace the global ones, rather than adding to them.
+func TestParseACLDefaults(t *testing.T) {
+	tun := &tunnel{Allow: []string{"198.51.100.0/24"}}
+	if err := tun.parseACL([]string{"192.0.2.0/24"}, []string{"198.51.100.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if tun.src.permits(netip.MustParseAddr("192.0.2.1")) {
+		t.Errorf("expected the global allow list to be replaced")
+	}
+	if tun.src.permits(netip.MustParseAddr("198.51.100.1")) {
+		t.Errorf("expected the global deny list to apply")
+	}
+	if err := (&tunnel{Deny: []string{"192.0.2.0/33"}}).parseACL(nil, nil); err == nil {
+		t.Errorf("expected an invalid CIDR to fail")
+	}
+}
+
+func TestParseTargetAllow(t *testing.T) {
+	allow, err := parseTargetAllow([]string{"10.0.0.0/8", "unix:/run/../run/app.sock", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allow.prefixes) != 2 || len(allow.paths) != 1 || allow.paths[0] != "/run/app.sock" {
+		t.Fatalf("expected 2 prefixes and the clean path, got %v", allow)
+	}
+	for _, bad := range []string{"unix:app.sock", "10.0.0.0/33", "example.com"} {
+		if _, err := parseTargetAllow([]string{bad}); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
+
+// Sets the target allowlist for the test.
+func setTargetAllow(t *testing.T, list ...string) {
+	allow, err := parseTargetAllow(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := targetAllow
+	targetAllow = allow
+	t.Cleanup(func() { targetAllow = prev })
+}
+
+func TestCheckTarget(t *testing.T) {
+	for _, c := range []struct {
+		name             string
+		allow            []string
+		network, address string
+		expect           error
+	}{
+		{"empty", nil, "tcp4", "192.0.2.1:22", nil},
+		{"empty unix", nil, "unix", "/run/app.sock", nil},
+		{"allowed", []string{"192.0.2.0/24"}, "tcp4", "192.0.2.1:22", nil},
+		{"mapped", []string{"192.0.2.0/24"}, "tcp6", "[::ffff:192.0.2.1]:22", nil},
+		{"not allowed", []string{"192.0.2.0/24"}, "tcp4", "198.51.100.1:22", errTargetDenied},
+		{"unix listed", []string{"unix:/run/app.sock"}, "unix", "/run/app.sock", nil},
+		{"unix unlisted", []string{"unix:/run/app.sock"}, "unix", "/run/other.sock", errTargetDenied},
+		{"unix with cidrs only", []string{"192.0.2.0/24"}, "unix", "/run/app.sock", errTargetDenied},
+		{"addr with paths only", []string{"unix:/run/app.sock"}, "tcp4", "192.0.2.1:22", errTargetDenied},
+	} {
+		setTargetAllow(t, c.allow...)
+		if err := checkTarget(c.network, c.address, nil); !errors.Is(err, c.expect) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expect, err)
+		}
+	}
+}
+
+// The allowlist applies to the resolved addr of a target given by name.
+func TestDialEndpointResolved(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	tun := &tunnel{Target: "tcp4:localhost:" + port}
+
+	setTargetAllow(t, "192.0.2.0/24")
+	if _, err := dialEndpoint(tun); !errors.Is(err, errTargetDenied) {
+		t.Fatalf("expected %v, got %v", errTargetDenied, err)
+	}
+	setTargetAllow(t, "127.0.0.0/8")
+	c, err := dialEndpoint(tun)
+	if err != nil {
+		t.Fatalf("expected the loopback target to be allowed, got %v", err)
+	}
+	c.Close()
+
+	sock := filepath.Join(t.TempDir(), "app.sock")
+	uln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uln.Close()
+	if _, err := dialEndpoint(&tunnel{Target: unixPrefix + sock}); !errors.Is(err, errTargetDenied) {
+		t.Fatalf("unix: expected %v, got %v", errTargetDenied, err)
+	}
+	setTargetAllow(t, unixPrefix+sock)
+	c, err = dialEndpoint(&tunnel{Target: unixPrefix + sock})
+	if err != nil {
+		t.Fatalf("unix: expected the listed path to be allowed, got %v", err)
+	}
+	c.Close()
+}
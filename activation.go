@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// First fd passed by systemd socket activation, see sd_listen_fds(3).
+const listenFdsStart = 3
+
+// A listening socket passed by systemd, named by FileDescriptorName= of its socket unit. It stays
+// open for the lifetime of the process, since it can't be opened again.
+type activatedSocket struct {
+	name  string
+	ln    net.Listener
+	taken bool // By a tunnel, until its borrowedListener is closed
+}
+
+var (
+	activatedOnce    sync.Once
+	activatedMu      sync.Mutex
+	activatedSockets []*activatedSocket
+	activatedErr     error
+)
+
+// Reads the sockets passed in LISTEN_FDS, if they are meant for this process. The variables are
+// unset afterwards so that they aren't inherited.
+func loadActivatedSockets() ([]*activatedSocket, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS [%s]", os.Getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	var sockets []*activatedSocket
+	for i := range n {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("systemd socket %d [%s]: %w", i, name, err)
+		}
+		sockets = append(sockets, &activatedSocket{name: name, ln: ln})
+	}
+	return sockets, nil
+}
+
+// Takes the listener passed by systemd with the name, or else with the index among those passed.
+// Each can only be used by one listen addr at a time, and is returned once closed, e.g. so that a
+// reload can move it to another tunnel.
+func activatedListener(spec string) (net.Listener, error) {
+	activatedOnce.Do(func() {
+		activatedSockets, activatedErr = loadActivatedSockets()
+	})
+	if activatedErr != nil {
+		return nil, activatedErr
+	}
+	activatedMu.Lock()
+	defer activatedMu.Unlock()
+	s := findActivatedSocket(spec)
+	if s == nil {
+		return nil, fmt.Errorf("no systemd socket [%s] passed", spec)
+	} else if s.taken {
+		return nil, fmt.Errorf("systemd socket [%s] is already in use", spec)
+	}
+	s.taken = true
+	return &borrowedListener{Listener: s.ln, s: s}, nil
+}
+
+// borrowedListener is a taken systemd socket. Close ends pending accepts, but keeps the socket
+// open and returns it to the sockets passed by systemd.
+type borrowedListener struct {
+	net.Listener
+	s *activatedSocket
+
+	mu        sync.Mutex
+	closed    bool
+	accepting sync.WaitGroup
+}
+
+func (l *borrowedListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	l.accepting.Add(1)
+	l.mu.Unlock()
+	defer l.accepting.Done()
+	c, err := l.Listener.Accept()
+	if err != nil && l.isClosed() {
+		return nil, net.ErrClosed
+	}
+	return c, err
+}
+
+func (l *borrowedListener) isClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
+func (l *borrowedListener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return net.ErrClosed
+	}
+	l.closed = true
+	l.mu.Unlock()
+	d, ok := l.Listener.(interface{ SetDeadline(time.Time) error })
+	if !ok {
+		// Not a tcp or unix socket, which FileListener doesn't return
+		return l.Listener.Close()
+	}
+	// Ends pending accepts, and then lets the next taker accept again
+	d.SetDeadline(time.Now())
+	l.accepting.Wait()
+	d.SetDeadline(time.Time{})
+	activatedMu.Lock()
+	defer activatedMu.Unlock()
+	l.s.taken = false
+	return nil
+}
+
+func findActivatedSocket(spec string) *activatedSocket {
+	for _, s := range activatedSockets {
+		if s.name == spec {
+			return s
+		}
+	}
+	if i, err := strconv.Atoi(spec); err == nil && i >= 0 && i < len(activatedSockets) {
+		return activatedSockets[i]
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/betamos/rdv"
+)
+
+// Environment variable for the cluster secret, to keep it out of the process list.
+const clusterSecretEnv = "RDV_CLUSTER_SECRET"
+
+// Returns a lobby shared by the cluster nodes, or nil for the default in-memory lobby.
+//
+//   - self: url of this node, which must be one of the nodes
+//   - nodes: comma-separated urls of all nodes, identical on every node
+//   - secret: shared secret authenticating forwarded conns
+//   - allowHTTP: whether http nodes may receive the secret in plaintext
+//   - tlsConf: config for connecting to https nodes, nil for the system roots
+//   - lobbyTimeout: max time a peer waits for its partner, 0 for no limit
+//   - limits: of the relays between forwarded conns and their owners
+func newLobby(self, nodes, secret string, allowHTTP bool, tlsConf *tls.Config, lobbyTimeout time.Duration, limits relayLimits) (rdv.Lobby, error) {
+	if nodes == "" {
+		if self != "" {
+			return nil, errors.New("cluster self requires cluster nodes")
+		}
+		return nil, nil
+	}
+	var nodeList []string
+	for _, node := range strings.Split(nodes, ",") {
+		node = strings.TrimSpace(node)
+		u, err := url.Parse(node)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid cluster node [%s]", node)
+		}
+		if u.Scheme == "http" && !allowHTTP {
+			return nil, fmt.Errorf("cluster node [%s] would receive the secret in plaintext, use https or -cluster-http", node)
+		}
+		nodeList = append(nodeList, node)
+	}
+	if !slices.Contains(nodeList, self) {
+		return nil, fmt.Errorf("cluster self [%s] is not one of the cluster nodes", self)
+	}
+	if secret == "" {
+		return nil, fmt.Errorf("cluster requires a secret, see -cluster-secret or %s", clusterSecretEnv)
+	}
+	if limits.IdleTimeout > 0 && (lobbyTimeout <= 0 || lobbyTimeout > limits.IdleTimeout) {
+		// The forwarding node sees no traffic while the conn waits in the lobby of the owner
+		slog.Warn("cluster: forwarded peers wait at most the relay idle timeout, see -lobby-timeout", "relay_idle", limits.IdleTimeout)
+	}
+	// The owner applies the max duration and bytes to the relay of the pair, whereas the
+	// forwarding node only relays to the owner
+	return &rdv.ClusterLobby{
+		Self:         self,
+		Nodes:        nodeList,
+		Secret:       secret,
+		LobbyTimeout: lobbyTimeout,
+		Relayer:      limits.relayer(),
+		TlsConfig:    tlsConf,
+		AllowHTTP:    allowHTTP,
+		Logger:       slog.Default(),
+	}, nil
+}
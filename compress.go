@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"github.com/xtaci/smux"
+)
+
+const (
+	compressNone    = "none"
+	compressDeflate = "deflate"
+
+	blockRaw     = 0
+	blockDeflate = 1
+
+	blockHeaderSize = 3      // Kind and big-endian uint16 length
+	maxBlockSize    = 0xffff // Of both the raw and the compressed data, and of the inflated data
+
+	// Incompressible blocks in a row, after which the following blocks are sent raw without
+	// trying, to save cpu on e.g. encrypted or already compressed data.
+	bypassAfter  = 4
+	bypassBlocks = 16
+)
+
+var errBadBlock = errors.New("bad compressed block")
+
+// Returns the compression of a tunnel, "" for none.
+func (t *tunnel) compression() string {
+	if c := cmp.Or(t.Compress, flagCompress); c != compressNone {
+		return c
+	}
+	return ""
+}
+
+func validCompression(c string) bool {
+	return c == "" || c == compressNone || c == compressDeflate
+}
+
+// compressConn deflates the payload of a stream in both directions. Writes are sent as blocks,
+// each of which is either deflated or raw, whichever is smaller, so that incompressible data
+// costs little. Blocks are compressed independently and never buffered, so half-close and
+// interactive traffic work as without compression.
+type compressConn struct {
+	stream *smux.Stream
+
+	fw      *flate.Writer
+	wbuf    bytes.Buffer
+	wframe  []byte
+	misses  int // Incompressible blocks in a row
+	bypass  int // Blocks left to send raw
+	rawOut  atomic.Int64
+	wireOut atomic.Int64
+
+	fr     io.ReadCloser
+	hdr    [blockHeaderSize]byte
+	in     []byte
+	out    bytes.Buffer
+	rbuf   []byte // Pending data of the last block read
+	rawIn  atomic.Int64
+	wireIn atomic.Int64
+}
+
+func newCompressConn(stream *smux.Stream) *compressConn {
+	fw, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return &compressConn{
+		stream: stream,
+		fw:     fw,
+		wframe: make([]byte, blockHeaderSize+maxBlockSize),
+		fr:     flate.NewReader(nil),
+		in:     make([]byte, maxBlockSize),
+	}
+}
+
+// Returns an opened stream with the compression requested in its metadata, if any, along with the
+// compressConn for stats. Older peers get no metadata, and no compression.
+func compressOpened(stream *smux.Stream, meta streamMeta) (io.ReadWriteCloser, *compressConn) {
+	if meta.Compress == "" || len(stream.Meta()) == 0 {
+		return stream, nil
+	}
+	cc := newCompressConn(stream)
+	return cc, cc
+}
+
+func (c *compressConn) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		b := p[:min(len(p), maxBlockSize)]
+		if err := c.writeBlock(b); err != nil {
+			return n, err
+		}
+		n += len(b)
+		p = p[len(b):]
+	}
+	return n, nil
+}
+
+func (c *compressConn) writeBlock(b []byte) error {
+	var kind byte = blockRaw
+	payload := b
+	if c.bypass > 0 {
+		c.bypass--
+	} else {
+		c.wbuf.Reset()
+		c.fw.Reset(&c.wbuf)
+		c.fw.Write(b)
+		c.fw.Close()
+		if c.wbuf.Len() < len(b)*9/10 {
+			kind, payload = blockDeflate, c.wbuf.Bytes()
+			c.misses = 0
+		} else if c.misses++; c.misses >= bypassAfter {
+			c.bypass, c.misses = bypassBlocks, 0
+		}
+	}
+	frame := c.wframe[:blockHeaderSize+len(payload)]
+	frame[0] = kind
+	binary.BigEndian.PutUint16(frame[1:], uint16(len(payload)))
+	copy(frame[blockHeaderSize:], payload)
+	if _, err := c.stream.Write(frame); err != nil {
+		return err
+	}
+	c.rawOut.Add(int64(len(b)))
+	c.wireOut.Add(int64(len(frame)))
+	return nil
+}
+
+func (c *compressConn) Read(p []byte) (int, error) {
+	for len(c.rbuf) == 0 {
+		if err := c.readBlock(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *compressConn) readBlock() error {
+	if _, err := io.ReadFull(c.stream, c.hdr[:]); err != nil {
+		return err // EOF between blocks is clean
+	}
+	in := c.in[:binary.BigEndian.Uint16(c.hdr[1:])]
+	if _, err := io.ReadFull(c.stream, in); err != nil {
+		return noEOF(err)
+	}
+	c.wireIn.Add(int64(blockHeaderSize + len(in)))
+	switch c.hdr[0] {
+	case blockRaw:
+		c.rbuf = in
+	case blockDeflate:
+		c.fr.(flate.Resetter).Reset(bytes.NewReader(in), nil)
+		c.out.Reset()
+		// A block never inflates beyond the max block size, so that a small block can't expand
+		// into a large buffer
+		if _, err := c.out.ReadFrom(io.LimitReader(c.fr, maxBlockSize+1)); err != nil {
+			return fmt.Errorf("%w: %w", errBadBlock, err)
+		}
+		if c.out.Len() > maxBlockSize {
+			return errBadBlock
+		}
+		c.rbuf = c.out.Bytes()
+	default:
+		return errBadBlock
+	}
+	c.rawIn.Add(int64(len(c.rbuf)))
+	return nil
+}
+
+func (c *compressConn) CloseWrite() error {
+	return c.stream.CloseWrite()
+}
+
+func (c *compressConn) Close() error {
+	return c.stream.Close()
+}
+
+// Reports the raw and wire bytes in each direction.
+func (c *compressConn) String() string {
+	return fmt.Sprintf("out %d -> %d (%s), in %d <- %d (%s)",
+		c.rawOut.Load(), c.wireOut.Load(), percent(c.wireOut.Load(), c.rawOut.Load()),
+		c.rawIn.Load(), c.wireIn.Load(), percent(c.wireIn.Load(), c.rawIn.Load()))
+}
+
+func percent(a, b int64) string {
+	if b == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.0f%%", float64(a)*100/float64(b))
+}
+
+// Returns io.ErrUnexpectedEOF instead of io.EOF, for a truncated block.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
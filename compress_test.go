@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/xtaci/smux"
+)
+
+// Returns a pair of connected smux streams over a pipe.
+func testStreamPair(t *testing.T) (*smux.Stream, *smux.Stream) {
+	c1, c2 := net.Pipe()
+	client, err := smux.Client(c1, smux.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := smux.Server(c2, smux.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	accepted := make(chan *smux.Stream, 1)
+	go func() {
+		s, _ := server.AcceptStream()
+		accepted <- s
+	}()
+	s1, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s1, <-accepted
+}
+
+func randBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+// Writes the data and half-closes in the background, and returns what the reader got until EOF.
+func transfer(t *testing.T, w *compressConn, r io.Reader, data []byte) []byte {
+	go func() {
+		w.Write(data)
+		w.CloseWrite()
+	}()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	text := bytes.Repeat([]byte("compressible text, "), 20000)
+	for name, data := range map[string][]byte{
+		"empty":             {},
+		"small":             []byte("hi"),
+		"text":              text,
+		"random":            randBytes(300 << 10),
+		"random, then text": append(randBytes(maxBlockSize*(bypassAfter+bypassBlocks+1)), text...),
+		"one block":         text[:maxBlockSize],
+		"one block more":    text[:maxBlockSize+1],
+	} {
+		s1, s2 := testStreamPair(t)
+		w, r := newCompressConn(s1), newCompressConn(s2)
+		got := transfer(t, w, r, data)
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: expected %d bytes, got %d", name, len(data), len(got))
+		}
+		if w.rawOut.Load() != int64(len(data)) || r.rawIn.Load() != int64(len(data)) {
+			t.Errorf("%s: expected %d raw bytes, got %d out and %d in", name, len(data), w.rawOut.Load(), r.rawIn.Load())
+		}
+		if w.wireOut.Load() != r.wireIn.Load() {
+			t.Errorf("%s: expected equal wire bytes, got %d out and %d in", name, w.wireOut.Load(), r.wireIn.Load())
+		}
+	}
+}
+
+// Reads the blocks of a compressed stream, without decoding them.
+func readBlocks(t *testing.T, r io.Reader) (kinds []byte, sizes []int) {
+	var hdr [blockHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err == io.EOF {
+			return
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		n := int(binary.BigEndian.Uint16(hdr[1:]))
+		if _, err := io.CopyN(io.Discard, r, int64(n)); err != nil {
+			t.Fatal(err)
+		}
+		kinds, sizes = append(kinds, hdr[0]), append(sizes, n)
+	}
+}
+
+func TestCompressFraming(t *testing.T) {
+	s1, s2 := testStreamPair(t)
+	w := newCompressConn(s1)
+	text := bytes.Repeat([]byte("abc"), maxBlockSize) // 3 blocks
+	go func() {
+		w.Write(text)
+		w.CloseWrite()
+	}()
+	kinds, sizes := readBlocks(t, s2)
+	if len(kinds) != 3 {
+		t.Fatalf("expected 3 blocks, got %d", len(kinds))
+	}
+	for i, kind := range kinds {
+		if kind != blockDeflate || sizes[i] > maxBlockSize/10 {
+			t.Errorf("block %d: expected a small deflated block, got kind %d of %d bytes", i, kind, sizes[i])
+		}
+	}
+}
+
+// After bypassAfter incompressible blocks in a row, the following bypassBlocks are sent raw without
+// trying, after which compression is tried again.
+func TestCompressBypass(t *testing.T) {
+	s1, s2 := testStreamPair(t)
+	w := newCompressConn(s1)
+	text := bytes.Repeat([]byte("x"), maxBlockSize)
+	go func() {
+		for range bypassAfter {
+			w.Write(randBytes(maxBlockSize))
+		}
+		if w.bypass != bypassBlocks {
+			t.Errorf("expected bypass of %d blocks, got %d", bypassBlocks, w.bypass)
+		}
+		for range bypassBlocks {
+			w.Write(text)
+		}
+		w.Write(text)
+		w.CloseWrite()
+	}()
+	kinds, _ := readBlocks(t, s2)
+	expect := append(bytes.Repeat([]byte{blockRaw}, bypassAfter+bypassBlocks), blockDeflate)
+	if !bytes.Equal(kinds, expect) {
+		t.Fatalf("expected blocks %v, got %v", expect, kinds)
+	}
+}
+
+// A compressible block after fewer misses than bypassAfter resets the count.
+func TestCompressBypassReset(t *testing.T) {
+	s1, s2 := testStreamPair(t)
+	w := newCompressConn(s1)
+	go io.Copy(io.Discard, s2)
+	for range bypassAfter - 1 {
+		w.Write(randBytes(maxBlockSize))
+	}
+	w.Write(bytes.Repeat([]byte("x"), maxBlockSize))
+	if w.misses != 0 || w.bypass != 0 {
+		t.Fatalf("expected the misses to reset, got %d misses and bypass %d", w.misses, w.bypass)
+	}
+}
+
+func deflate(b []byte) []byte {
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.BestCompression)
+	fw.Write(b)
+	fw.Close()
+	return buf.Bytes()
+}
+
+func block(kind byte, payload []byte) []byte {
+	b := []byte{kind, 0, 0}
+	binary.BigEndian.PutUint16(b[1:], uint16(len(payload)))
+	return append(b, payload...)
+}
+
+func TestCompressMalformed(t *testing.T) {
+	bomb := deflate(make([]byte, 1<<20))
+	if len(bomb) > maxBlockSize {
+		t.Fatalf("bomb of %d bytes doesn't fit a block", len(bomb))
+	}
+	for name, c := range map[string]struct {
+		in     []byte
+		expect error
+	}{
+		"unknown kind":      {block(7, []byte("data")), errBadBlock},
+		"bad deflate":       {block(blockDeflate, []byte{0xff, 0xff, 0xff}), errBadBlock},
+		"truncated deflate": {block(blockDeflate, deflate([]byte("data"))[:2]), errBadBlock},
+		"bomb":              {block(blockDeflate, bomb), errBadBlock},
+		"truncated block":   {block(blockRaw, []byte("data"))[:5], io.ErrUnexpectedEOF},
+		"truncated header":  {[]byte{blockRaw, 0}, io.ErrUnexpectedEOF},
+	} {
+		s1, s2 := testStreamPair(t)
+		go func() {
+			s1.Write(c.in)
+			s1.CloseWrite()
+		}()
+		_, err := io.ReadAll(newCompressConn(s2))
+		if !errors.Is(err, c.expect) {
+			t.Errorf("%s: expected %v, got %v", name, c.expect, err)
+		}
+	}
+}
+
+// The largest block which inflates within the cap is accepted.
+func TestCompressMaxInflated(t *testing.T) {
+	s1, s2 := testStreamPair(t)
+	data := make([]byte, maxBlockSize)
+	go func() {
+		s1.Write(block(blockDeflate, deflate(data)))
+		s1.CloseWrite()
+	}()
+	got, err := io.ReadAll(newCompressConn(s2))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("expected %d bytes, got %d, %v", len(data), len(got), err)
+	}
+}
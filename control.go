@@ -0,0 +1,379 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/betamos/rdv"
+	"github.com/xtaci/smux"
+)
+
+var errReconnect = errors.New("reconnect requested")
+
+// Header required by the requests of the control endpoint which change anything. Neither a form
+// nor a cross-origin script can send it, so a web page can't make a local browser send these.
+const controlHeader = "X-Relayp2p-Control"
+
+// States of a pooled conn, see memberStatus.
+const (
+	stateConnecting   = "connecting"   // Not connected yet
+	stateP2P          = "p2p"          // Connected directly
+	stateRelay        = "relay"        // Connected through the rdv server
+	stateReconnecting = "reconnecting" // Lost or failed, retrying
+	stateStopped      = "stopped"      // Gave up, see clientCmd
+)
+
+// The state of a pooled conn of a session group, reported by the control endpoint.
+type memberStatus struct {
+	mu        sync.Mutex
+	state     string
+	isRelay   bool
+	remote    string
+	observed  string
+	since     time.Time     // Of the current conn
+	conn      *countingConn // Current conn, nil if not connected
+	lastErr   string
+	lastErrAt time.Time
+	requested bool // Closed by a reconnect, reported instead of the error of the session
+
+	kick chan struct{} // Ends a wait before reconnecting, see sessionGroup.reconnect
+}
+
+func newMemberStatus(pool int) []memberStatus {
+	status := make([]memberStatus, pool)
+	for i := range status {
+		status[i].state = stateConnecting
+		status[i].kick = make(chan struct{}, 1)
+	}
+	return status
+}
+
+func (m *memberStatus) connected(conn *rdv.Conn, cc *countingConn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state = stateP2P
+	if conn.IsRelay {
+		m.state = stateRelay
+	}
+	m.isRelay = conn.IsRelay
+	m.remote = conn.RemoteAddr().String()
+	m.observed = ""
+	if conn.ObservedAddr != nil {
+		m.observed = conn.ObservedAddr.String()
+	}
+	m.since = time.Now()
+	m.conn = cc
+}
+
+// Records a failed attempt or a lost session, nil err for a session closed without an error.
+func (m *memberStatus) failed(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state = stateReconnecting
+	m.conn = nil
+	if m.requested {
+		err, m.requested = errReconnect, false
+	}
+	if err != nil {
+		m.lastErr = err.Error()
+		m.lastErrAt = time.Now()
+	}
+}
+
+func (m *memberStatus) stopped(err error) {
+	m.failed(err)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state = stateStopped
+}
+
+// countingConn counts the bytes of an rdv conn, including the smux framing.
+type countingConn struct {
+	net.Conn
+	in, out atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.in.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.out.Add(int64(n))
+	return n, err
+}
+
+// Closes the sessions of the group's pooled conns so that they reconnect without waiting for the
+// backoff. Stopped conns aren't restarted. If relayed, connected conns are only closed if they're
+// relayed, so that p2p is attempted again, e.g. after a network change. Returns the number of
+// conns.
+func (g *sessionGroup) reconnect(relayed bool) int {
+	n := 0
+	for i := range g.members {
+		st := &g.status[i]
+		st.mu.Lock()
+		skip := relayed && st.conn != nil && !st.isRelay || st.state == stateStopped
+		st.requested = !skip && st.conn != nil
+		st.mu.Unlock()
+		if skip {
+			continue
+		}
+		if sess := g.members[i].Load(); sess != nil {
+			// The peer's session fails as well, so both sides connect anew
+			sess.Close()
+		}
+		select {
+		case st.kick <- struct{}{}:
+		default:
+		}
+		n++
+	}
+	return n
+}
+
+// Reports whether the pooled conn of the session is relayed.
+func (g *sessionGroup) relayed(sess *smux.Session) bool {
+	for i := range g.members {
+		if g.members[i].Load() == sess {
+			st := &g.status[i]
+			st.mu.Lock()
+			defer st.mu.Unlock()
+			return st.isRelay
+		}
+	}
+	return false
+}
+
+// The status report of the control endpoint, one entry per pooled conn of each session.
+type controlStatus struct {
+	Mode     string          `json:"mode"`
+	Uptime   string          `json:"uptime"`
+	Sessions []sessionStatus `json:"sessions"`
+}
+
+type sessionStatus struct {
+	Session   string   `json:"session"`
+	Member    int      `json:"member"`
+	Stdio     bool     `json:"stdio,omitempty"` // The member serving stdio runs, see stdioCmd
+	Tunnels   []string `json:"tunnels"`
+	State     string   `json:"state"`
+	IsRelay   bool     `json:"is_relay"`
+	Remote    string   `json:"remote,omitempty"`
+	Observed  string   `json:"observed,omitempty"`
+	RTT       string   `json:"rtt,omitempty"` // Of the latest smux ping, if the peer supports it
+	Streams   int      `json:"streams"`
+	BytesIn   int64    `json:"bytes_in"`
+	BytesOut  int64    `json:"bytes_out"`
+	Uptime    string   `json:"uptime,omitempty"`
+	LastError string   `json:"last_error,omitempty"`
+	LastErrAt string   `json:"last_error_at,omitempty"`
+}
+
+func (r *clientRun) status() controlStatus {
+	s := controlStatus{Mode: r.method, Uptime: time.Since(r.started).Round(time.Second).String()}
+	for _, g := range r.groupList() {
+		var tunnels []string
+		for _, t := range g.tunnelList() {
+			tunnels = append(tunnels, t.Name)
+		}
+		for i := range g.members {
+			st := &g.status[i]
+			st.mu.Lock()
+			ss := sessionStatus{
+				Session:   g.name,
+				Member:    i,
+				Stdio:     g.isStdio(i),
+				Tunnels:   tunnels,
+				State:     st.state,
+				LastError: st.lastErr,
+			}
+			if st.conn != nil {
+				ss.IsRelay = st.isRelay
+				ss.Remote = st.remote
+				ss.Observed = st.observed
+				ss.BytesIn = st.conn.in.Load()
+				ss.BytesOut = st.conn.out.Load()
+				ss.Uptime = time.Since(st.since).Round(time.Second).String()
+			}
+			if !st.lastErrAt.IsZero() {
+				ss.LastErrAt = st.lastErrAt.Format(time.RFC3339)
+			}
+			st.mu.Unlock()
+			if sess := g.members[i].Load(); sess != nil {
+				ss.Streams = sess.NumStreams()
+				if rtt := sess.RTT(); rtt > 0 {
+					ss.RTT = rtt.Round(10 * time.Microsecond).String()
+				}
+			}
+			s.Sessions = append(s.Sessions, ss)
+		}
+	}
+	return s
+}
+
+// Listens on the -control endpoint: a unix socket, only accessible by the user, or a loopback
+// addr.
+func listenControl(addr string) (net.Listener, error) {
+	network, address := parseEndpoint(addr)
+	switch network {
+	case "unix":
+		if err := removeStaleSocket(address); err != nil {
+			return nil, err
+		}
+		ln, err := net.Listen(network, address)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(address, 0600); err != nil {
+			ln.Close()
+			return nil, err
+		}
+		return ln, nil
+	case "", "tcp", "tcp4", "tcp6":
+		ap, err := netip.ParseAddrPort(address)
+		if err != nil || !ap.Addr().IsLoopback() {
+			return nil, fmt.Errorf("control addr [%s] must be a unix socket or a loopback ip and port", addr)
+		}
+		return net.Listen("tcp", address)
+	}
+	return nil, fmt.Errorf("control addr [%s] must be a unix socket or a loopback ip and port", addr)
+}
+
+// Serves the control endpoint of the run until the listener is closed, see controlHandler.
+func (r *clientRun) serveControl(ln net.Listener) {
+	srv := &http.Server{Handler: r.controlHandler(), ReadHeaderTimeout: 5 * time.Second}
+	if err := srv.Serve(ln); !errors.Is(err, net.ErrClosed) {
+		slog.Error("client: control endpoint failed", "err", err)
+	}
+}
+
+// Returns the handler of the control endpoint:
+//
+//	GET /status                      the controlStatus as json
+//	POST /reconnect?session=<name>   reconnects the session, or all if no name is given
+//	POST /repunch?session=<name>     reconnects the relayed conns of the session, or of all
+//
+// POST requests require the controlHeader.
+func (r *clientRun) controlHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.status())
+	})
+	reconnect := func(relayed bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			if req.Header.Get(controlHeader) == "" {
+				http.Error(w, fmt.Sprintf("missing %s header", controlHeader), http.StatusForbidden)
+				return
+			}
+			name := req.FormValue("session")
+			n, found := 0, false
+			for _, g := range r.groupList() {
+				if name == "" || g.name == name {
+					n += g.reconnect(relayed)
+					found = true
+				}
+			}
+			if !found {
+				http.Error(w, fmt.Sprintf("no session [%s]", name), http.StatusNotFound)
+				return
+			}
+			slog.Info("client: reconnect requested", "session", name, "relayed_only", relayed, "conns", n)
+			fmt.Fprintln(w, n)
+		}
+	}
+	mux.HandleFunc("POST /reconnect", reconnect(false))
+	mux.HandleFunc("POST /repunch", reconnect(true))
+	return mux
+}
+
+// Queries the control endpoint of a running dial or accept process, or with the args reconnect
+// or repunch, and optionally a session name, asks it to reconnect.
+func statusCmd(addr string, args []string) error {
+	network, address := parseEndpoint(addr)
+	if network == "" || network == "tcp4" || network == "tcp6" {
+		network = "tcp"
+	}
+	hc := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, address)
+			},
+		},
+	}
+	// The host is ignored by the dialer
+	const base = "http://relayp2p"
+	if len(args) > 0 {
+		if args[0] != "reconnect" && args[0] != "repunch" || len(args) > 2 {
+			return fmt.Errorf("unknown status command [%s]", strings.Join(args, " "))
+		}
+		u := base + "/" + args[0]
+		if len(args) == 2 {
+			u += "?" + url.Values{"session": {args[1]}}.Encode()
+		}
+		req, err := http.NewRequest(http.MethodPost, u, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(controlHeader, "1")
+		resp, err := hc.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			return errors.New(strings.TrimSpace(string(b)))
+		}
+		fmt.Printf("reconnecting %s conns\n", strings.TrimSpace(string(b)))
+		return nil
+	}
+
+	resp, err := hc.Get(base + "/status")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var s controlStatus
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return err
+	}
+	fmt.Printf("mode %s, up %s\n", s.Mode, s.Uptime)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SESSION\tTUNNELS\tSTATE\tREMOTE\tOBSERVED\tRTT\tSTREAMS\tIN\tOUT\tUPTIME\tLAST ERROR")
+	for _, ss := range s.Sessions {
+		name := ss.Session
+		if ss.Stdio {
+			name += "/stdio"
+		} else if ss.Member > 0 {
+			name = fmt.Sprintf("%s/%d", name, ss.Member)
+		}
+		lastErr := "-"
+		if ss.LastError != "" {
+			lastErr = ss.LastErrAt + " " + ss.LastError
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%s\t%s\n", name, strings.Join(ss.Tunnels, ","),
+			ss.State, cmp.Or(ss.Remote, "-"), cmp.Or(ss.Observed, "-"), cmp.Or(ss.RTT, "-"), ss.Streams,
+			ss.BytesIn, ss.BytesOut, cmp.Or(ss.Uptime, "-"), lastErr)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/betamos/rdv"
+)
+
+func TestControlHandler(t *testing.T) {
+	groups := groupTunnels([]*tunnel{{Name: "a"}, {Name: "b"}}, "test", 2, false)
+	r := newClientRun(nil, rdv.DIAL, nil, groups)
+	h := r.controlHandler()
+	for _, c := range []struct {
+		method, path string
+		header       bool
+		expect       int
+		body         string
+	}{
+		{"POST", "/reconnect", false, http.StatusForbidden, ""},
+		{"POST", "/repunch?session=a", false, http.StatusForbidden, ""},
+		{"POST", "/reconnect", true, http.StatusOK, "4\n"},
+		{"POST", "/reconnect?session=a", true, http.StatusOK, "2\n"},
+		{"POST", "/repunch?session=b", true, http.StatusOK, "2\n"},
+		{"POST", "/reconnect?session=c", true, http.StatusNotFound, ""},
+		{"GET", "/reconnect", true, http.StatusMethodNotAllowed, ""},
+		{"POST", "/status", true, http.StatusMethodNotAllowed, ""},
+		{"GET", "/other", false, http.StatusNotFound, ""},
+	} {
+		req := httptest.NewRequest(c.method, c.path, nil)
+		if c.header {
+			req.Header.Set(controlHeader, "1")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != c.expect {
+			t.Errorf("%s %s: expected %d, got %d %s", c.method, c.path, c.expect, w.Code, w.Body)
+		} else if c.body != "" && w.Body.String() != c.body {
+			t.Errorf("%s %s: expected %q, got %q", c.method, c.path, c.body, w.Body)
+		}
+	}
+	// Each reconnect kicked the members waiting for a retry
+	select {
+	case <-groups[0].status[0].kick:
+	default:
+		t.Errorf("expected a kick of the waiting member")
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	var status controlStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Mode != rdv.DIAL || len(status.Sessions) != 4 || status.Sessions[2].Session != "b" ||
+		status.Sessions[2].State != stateConnecting {
+		t.Errorf("expected 2 connecting members of each session, got %+v", status)
+	}
+}
+
+func TestListenControl(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:0", "tcp4:127.0.0.2:0", "tcp:127.0.0.1:0"} {
+		ln, err := listenControl(addr)
+		if err != nil {
+			t.Errorf("%s: %v", addr, err)
+			continue
+		}
+		ln.Close()
+	}
+	if ln, err := listenControl("tcp6:[::1]:0"); err == nil {
+		ln.Close()
+	} else if strings.Contains(err.Error(), "loopback") {
+		t.Errorf("[::1]: expected loopback, got %v", err)
+	}
+	for _, addr := range []string{
+		"0.0.0.0:0", ":0", "[::]:0", "192.0.2.1:9090", "tcp6:[2001:db8::1]:9090",
+		"localhost:0", "udp:127.0.0.1:0", "127.0.0.1",
+	} {
+		if ln, err := listenControl(addr); err == nil {
+			ln.Close()
+			t.Errorf("%s: expected a non-loopback addr to be refused", addr)
+		}
+	}
+
+	// A unix socket is only accessible by the user
+	sock := filepath.Join(t.TempDir(), "control.sock")
+	ln, err := listenControl(unixPrefix + sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if fi, err := os.Stat(sock); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, got %v, %v", fi.Mode(), err)
+	}
+	c, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prefix of unix socket endpoints, e.g. unix:/var/run/docker.sock
+const unixPrefix = "unix:"
+
+// Networks that may prefix an endpoint, e.g. tcp6:[::1]:5002. The systemd network takes a socket
+// passed by socket activation, by name or index, and is for listen addrs only.
+var endpointNetworks = []string{"tcp", "tcp4", "tcp6", "unix", "systemd"}
+
+// Returns the network and address of a listen or target endpoint, or an empty network for an
+// addr without prefix. Listeners default to tcp4, as in earlier versions, and targets to tcp.
+func parseEndpoint(addr string) (network, address string) {
+	for _, n := range endpointNetworks {
+		if a, ok := strings.CutPrefix(addr, n+":"); ok {
+			return n, a
+		}
+	}
+	return "", addr
+}
+
+// Parses the octal permissions of a unix socket file, e.g. 0660. Empty means the umask default.
+func parseSocketMode(s string) (fs.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid socket mode [%s]", s)
+	}
+	return fs.FileMode(mode), nil
+}
+
+// Listens on one of the tunnel's local endpoints. A stale unix socket file from an earlier process
+// is removed first, and the permissions of the new one are set to the tunnel's mode.
+func listenEndpoint(t *tunnel, addr string) (net.Listener, error) {
+	network, address := parseEndpoint(addr)
+	switch network {
+	case "":
+		return net.Listen("tcp4", address)
+	case "systemd":
+		return activatedListener(address)
+	case "unix":
+	default:
+		return net.Listen(network, address)
+	}
+	mode, err := parseSocketMode(t.Mode)
+	if err != nil {
+		return nil, err
+	}
+	if err := removeStaleSocket(address); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(address, mode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// Removes a unix socket file left behind by a process that didn't exit cleanly, unless another
+// process is still listening on it.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		c.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	return os.Remove(path)
+}
+
+// Dials the tunnel's target endpoint, if allowed by the targetAllow.
+func dialEndpoint(t *tunnel) (net.Conn, error) {
+	network, address := parseEndpoint(t.Target)
+	d := net.Dialer{Timeout: 5 * time.Second, Control: checkTarget, KeepAlive: -1}
+	if t.keepAlive() > 0 {
+		d.KeepAlive = t.keepAlive()
+	}
+	return d.Dial(cmp.Or(network, "tcp"), address)
+}
+
+// Sets the keepalive period of an accepted tcp conn, 0 to disable. Listeners enable keepalive by
+// default, including those passed by systemd.
+func setKeepAlive(c net.Conn, period time.Duration) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	tc.SetKeepAlive(period > 0)
+	if period > 0 {
+		tc.SetKeepAlivePeriod(period)
+	}
+}
+
+// Describes the client of an accepted conn: the source addr, or the process credentials of a
+// unix socket client where supported.
+func sourceAddr(c net.Conn) string {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return c.RemoteAddr().String()
+	}
+	cred, err := peerCred(uc)
+	if err != nil {
+		return unixPrefix + uc.LocalAddr().String()
+	}
+	return unixPrefix + uc.LocalAddr().String() + " " + cred
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+var (
+	errIdle     = errors.New("forwarded conn idle")
+	errLifetime = errors.New("forwarded conn reached its max lifetime")
+)
+
+// Size of the buffers copying into smux streams: several frames, so that the frames of a bulk
+// transfer stay queued and the streams share the session by weight, see smux.Stream.SetWeight.
+const streamCopySize = 256 << 10
+
+var streamCopyBufs = sync.Pool{New: func() any { return new([streamCopySize]byte) }}
+
+// closeWriter is implemented by conns that can half-close, such as *net.TCPConn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Copies between a and b in both directions until both directions have finished, or until
+// neither direction has had any traffic for the idle timeout (0 disables), or until the deadline
+// of the max lifetime (zero disables), regardless of traffic. EOF is propagated per
+// direction by half-closing the writer, so that protocols that keep reading after their peer's
+// FIN work. If the writer can't half-close, both sides are closed instead.
+//
+// Both a and b are closed upon return. Returns the bytes copied from a to b and from b to a, and
+// the first error other than EOF, if any.
+func forward(a, b io.ReadWriteCloser, idleTimeout time.Duration, deadline time.Time) (ab, ba int64, err error) {
+	var (
+		once     sync.Once
+		firstErr error
+	)
+	closeBoth := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			a.Close()
+			b.Close()
+		})
+	}
+	var ra, rb io.Reader = a, b
+	if idleTimeout > 0 {
+		t := time.AfterFunc(idleTimeout, func() { closeBoth(errIdle) })
+		defer t.Stop()
+		ra = &activityReader{a, t, idleTimeout}
+		rb = &activityReader{b, t, idleTimeout}
+	}
+	if !deadline.IsZero() {
+		t := time.AfterFunc(time.Until(deadline), func() { closeBoth(errLifetime) })
+		defer t.Stop()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ba = copyHalf(a, rb, closeBoth)
+	}()
+	ab = copyHalf(b, ra, closeBoth)
+	wg.Wait()
+	closeBoth(nil)
+	return ab, ba, firstErr
+}
+
+// Copies until EOF and then half-closes the writer. Upon other errors, or if the writer can't
+// half-close, both sides are closed.
+func copyHalf(dst io.WriteCloser, src io.Reader, closeBoth func(error)) int64 {
+	n, err := copyInto(dst, src)
+	// Some readers, such as smux streams, return EOF from WriteTo
+	if err != nil && !errors.Is(err, io.EOF) {
+		closeBoth(err)
+		return n
+	}
+	cw, ok := dst.(closeWriter)
+	if !ok {
+		closeBoth(nil)
+		return n
+	}
+	if err := cw.CloseWrite(); errors.Is(err, smux.ErrHalfCloseUnsupported) {
+		// Older peers only support full close
+		closeBoth(nil)
+	} else if err != nil {
+		closeBoth(err)
+	}
+	return n
+}
+
+// Copies until EOF, with a larger buffer into smux streams.
+func copyInto(dst io.Writer, src io.Reader) (int64, error) {
+	if _, ok := dst.(*smux.Stream); !ok {
+		return io.Copy(dst, src)
+	}
+	buf := streamCopyBufs.Get().(*[streamCopySize]byte)
+	defer streamCopyBufs.Put(buf)
+	// Hides the WriteTo of src, e.g. of *net.TCPConn, which would use its own 32KB buffer
+	return io.CopyBuffer(dst, struct{ io.Reader }{src}, buf[:])
+}
+
+// activityReader postpones the idle timer whenever data is read.
+type activityReader struct {
+	r       io.Reader
+	t       *time.Timer
+	timeout time.Duration
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.t.Reset(r.timeout)
+	}
+	return n, err
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Forwards between two pipes, and returns the far ends and the result of forward.
+func testForward(idle time.Duration, deadline time.Time) (a, b net.Conn, done <-chan error) {
+	a, a2 := net.Pipe()
+	b, b2 := net.Pipe()
+	ch := make(chan error, 1)
+	go func() {
+		_, _, err := forward(a2, b2, idle, deadline)
+		ch <- err
+	}()
+	return a, b, ch
+}
+
+func TestForwardLimits(t *testing.T) {
+	// Traffic postpones the idle timeout, but not the lifetime
+	a, b, done := testForward(100*time.Millisecond, time.Now().Add(300*time.Millisecond))
+	defer a.Close()
+	defer b.Close()
+	go io.Copy(io.Discard, b)
+	start := time.Now()
+	for {
+		if _, err := a.Write([]byte("ping")); err != nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err := <-done; !errors.Is(err, errLifetime) {
+		t.Errorf("expected %v, got %v", errLifetime, err)
+	}
+	if took := time.Since(start); took < 250*time.Millisecond {
+		t.Errorf("expected the lifetime to pass first, took %v", took)
+	}
+	if _, err := b.Write([]byte("x")); err == nil {
+		t.Errorf("expected the other side to be closed too")
+	}
+
+	a, b, done = testForward(100*time.Millisecond, time.Now().Add(time.Minute))
+	defer a.Close()
+	defer b.Close()
+	if err := <-done; !errors.Is(err, errIdle) {
+		t.Errorf("expected %v, got %v", errIdle, err)
+	}
+
+	// A deadline passed already, e.g. by a slow dial, ends the forward right away
+	a, b, done = testForward(0, time.Now().Add(-time.Second))
+	defer a.Close()
+	defer b.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, errLifetime) {
+			t.Errorf("expected %v, got %v", errLifetime, err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected the forward to end")
+	}
+}
+
+func TestForwardEOF(t *testing.T) {
+	a, a2 := net.Pipe()
+	b, b2 := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := forward(a2, b2, time.Minute, time.Time{})
+		done <- err
+	}()
+	go func() {
+		a.Write([]byte("request"))
+		a.Close()
+	}()
+	got, _ := io.ReadAll(b)
+	b.Close()
+	if string(got) != "request" {
+		t.Errorf("expected the request, got %q", got)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
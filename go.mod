@@ -11,3 +11,7 @@ require (
 	github.com/libp2p/go-reuseport v0.4.0 // indirect
 	golang.org/x/sys v0.19.0 // indirect
 )
+
+replace github.com/betamos/rdv => ./third_party/rdv
+
+replace github.com/xtaci/smux => ./third_party/smux
@@ -1,321 +1,657 @@
-package main
-
-import (
-	"cmp"
-	"context"
-	"flag"
-	"fmt"
-	"log"
-	"log/slog"
-	"net"
-	"net/http"
-	"net/netip"
-	"os"
-	"os/signal"
-	"time"
-	"io"
-	"sync"
-	"strings"
-	"github.com/xtaci/smux"
-	"github.com/betamos/rdv"
-)
-
-var (
-	flagVerbose bool
-	flagWait    bool
-	flagSpaces  string
-	flagLAddr   string
-	remoteAddr   string
-	localAddr   string
-	
-	token   string
-	model   string
-	relayAddr string
-	isServer = false
-	pingInterval = 3
-)
-
-func usage() {
-	flag.PrintDefaults()
-}
-
-func init() {
-	flag.Usage = usage
-	
-	flag.StringVar(&flagSpaces, "s", "default", "client: enabled addr spaces, 'default', 'all', 'public', or 'none' (force relay) ")
-	flag.BoolVar(&flagWait, "w", false, "client: wait up to 5s for all p2p conns, for debugging")
-	flag.BoolVar(&flagVerbose, "v", false, "print verbose logs")
-	
-	flag.StringVar(&remoteAddr, "r", "192.167.1.6:3306,192.167.1.6:8485,:5678", "remote addrs")
-	flag.StringVar(&localAddr, "l", ":5002,:5003,:5004", "local addrs")
-	
-	flag.StringVar(&token, "token", "123456", "123456")
-	flag.StringVar(&model, "m", "serve", "dial、d or accept、a or serve")
-	flag.StringVar(&relayAddr, "rdv", "http://192.167.1.124:8686", "relayAddr")
-	flag.StringVar(&flagLAddr, "addr", ":8686", "server: listening addr")
-}
-/*
-    B:accept A:dial 
-*/
-//函数入口
-func main() {
-	var err error
-	flag.Parse()
-	if flagVerbose {
-		log.SetFlags(log.Lmicroseconds)
-		slog.SetLogLoggerLevel(slog.LevelDebug)
-	} else {
-		log.SetFlags(log.Ltime)
-	}
-	client := &rdv.Client{Logger: slog.Default()}
-	if flagWait {
-		client.Picker = rdv.WaitConstant(5 * time.Second)
-	}
-	// 'all', 'public', or 'none'
-	switch flagSpaces {
-	case "default":
-	case "all":
-		client.AddrSpaces = rdv.AllSpaces
-	case "public":
-		client.AddrSpaces = rdv.PublicSpaces
-	case "none":
-		client.AddrSpaces = rdv.NoSpaces
-	default:
-		usage()
-		os.Exit(2)
-	}
-	//serve dial  accept
-	switch model {
-	case "s", "serve":
-		err = serverCmd(flagLAddr)
-	case "d", "dial":
-	    isServer = false
-	    //remoteAddr
-	    remoteAddrs := strings.Split(remoteAddr, ",")  
-	    var wg sync.WaitGroup
-	    wg.Add(len(remoteAddrs))
-    	for i, addr := range remoteAddrs { 
-    	    go func() {
-    	        defer wg.Done()
-    	        slog.Info("client: peer connected", "remoteAddr", addr, "model", "dial", "token", fmt.Sprintf("%s:%d",token,i))
-        		err = clientCmd(client, addr, localAddr, fmt.Sprintf("%s:%d",token,i) ,rdv.DIAL)
-            	if err != nil {
-            		slog.Error("an error occurred", "err", err)
-            	}
-	    	}()
-    	}  
-    	wg.Wait()
-	case "a", "accept":
-	    isServer = true
-	    //remoteAddr
-	    localAddrs := strings.Split(localAddr, ",")  
-	    var wg sync.WaitGroup
-	    wg.Add(len(localAddrs))
-    	for i, addr := range localAddrs {
-    	    go func() {
-    	        defer wg.Done()
-    	        slog.Info("client: peer connected", "remoteAddr", addr, "model", "accept", "token", fmt.Sprintf("%s:%d",token,i))
-        		err = clientCmd(client, remoteAddr, addr, fmt.Sprintf("%s:%d",token,i) ,rdv.ACCEPT)
-            	if err != nil {
-            		slog.Error("an error occurred", "err", err)
-            	}
-    	    }()
-    	}
-    	wg.Wait()
-	default:
-		usage()
-		os.Exit(2)
-	}
-}
-
-func clientCmd(client *rdv.Client, remoteAddr, localAddr, token, method string) error {
-	for {
-	    tStart := time.Now()
-    	conn, _, err := client.Do(context.Background(), method, relayAddr, token, nil)
-    	if err != nil {
-    	    fmt.Printf("Error accepting connection: %v\n", err)  
-    		time.Sleep(3 * time.Second)
-			continue
-    	}
-    	obs := cmp.Or(conn.ObservedAddr, &netip.AddrPort{})
-    	space := rdv.AddrSpaceFrom(obs.Addr())
-    	if space != rdv.SpacePublic4 {
-    		slog.Warn("client: expected observed to be public ipv4 (check server config)", "addr", conn.ObservedAddr)
-    	}
-    	var tConnected = time.Now()
-    	slog.Info("client: peer connected", "is_relay", conn.IsRelay, "addr", conn.RemoteAddr(), "dur", tConnected.Sub(tStart))
-    	
-    	smuxConfig := smux.DefaultConfig()
-    	smuxConfig.MaxReceiveBuffer = 4194304
-    	smuxConfig.KeepAliveInterval = time.Duration(pingInterval) * time.Second
-    	smuxConfig.KeepAliveTimeout = time.Duration(pingInterval) * time.Second * 3
-
-    	// stream multiplex
-    	var smuxSession *smux.Session
-    	if isServer {
-    	    // 一个连接通道，分多个连接对接 本地 Accept
-    		smuxSession, err = smux.Server(conn, smuxConfig)
-        	
-            // 全局读取来自nat源的包
-        	listenTcpAddr, err := net.ResolveTCPAddr("tcp4", localAddr)
-        	checkError(err)
-        	listener, err := net.ListenTCP("tcp4", listenTcpAddr)
-        	checkError(err)
-        	log.Println("listening on:", listener.Addr())
-        	
-        // 	chTCPConn := make(chan *net.TCPConn, 16)
-        // 	go func() {
-        //     	tickerCheck := time.NewTicker( time.Duration(3)*time.Second)
-        //     	defer tickerCheck.Stop()
-        //     	for {
-        //     		select {
-        //     		case p1 := <-chTCPConn:
-        //     		    go handleLocalTcp(smuxSession, p1, !flagVerbose)
-        //     		case <-tickerCheck.C:
-        //     			if smuxSession.IsClosed(){
-        //     				log.Println("p2p session closed")
-        //     				return 
-        //     			}
-        //     		}
-        //     	}
-        // 	}()
-        	
-        	for{
-        		p1, err := listener.AcceptTCP()
-        		if err != nil {
-        			log.Fatalln(err)
-        			checkError(err)
-        		}
-        // 		chTCPConn <- p1
-        		go handleLocalTcp(smuxSession, p1, !flagVerbose)
-        	}
-    	} else {
-    	    log.Println("TargetTcp on:", remoteAddr)
-    	    // 一个连接通道，分多个连接对接 本地 dial
-    		smuxSession, err = smux.Client(conn, smuxConfig)
-    	    handleTargetTcp(remoteAddr, smuxSession, !flagVerbose)
-    	}
-	}
-	return nil
-}
-
-//handleTargetTcp
-func handleTargetTcp(addr string, session *smux.Session, quiet bool) {
-	for {
-		p1, err := session.AcceptStream()
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		//打洞成功之后，使用 tcp 通信，， 做一个标识，网卡ip，key 指定转发，
-		p2, err := net.DialTimeout("tcp", addr, 5*time.Second)
-		if err != nil {
-			p1.Close()
-			log.Println(err)
-			continue
-		}
-		go func() {
-			if !quiet {
-				log.Println("tcp client opened")
-				log.Println("TargetTcp " , addr)
-				defer log.Println("tcp client closed")
-			}
-			defer p1.Close()
-			defer p2.Close()
-
-			streamCopy := func(dst io.Writer, src io.ReadCloser) chan struct{} {
-            	//输出命令行
-				die := make(chan struct{})
-				go func() {
-				    io.Copy(dst, src)
-					close(die)
-				}()
-				return die
-			}
-			select {
-			    case <-streamCopy(p1, p2):
-			    case <-streamCopy(p2, p1):
-			}
-		}()
-		
-	}
-}
-
-//handleLocalTcp
-func handleLocalTcp(sess *smux.Session, p1 io.ReadWriteCloser, quiet bool) {
-	if !quiet {
-		log.Println("stream opened")
-		defer log.Println("stream closed")
-	}
-	defer p1.Close()
-	p2, err := sess.OpenStream()
-	if err != nil {
-		return
-	}
-	defer p2.Close()
-	streamCopy := func(dst io.Writer, src io.ReadCloser) chan struct{} {
-    	//输出命令行
-		die := make(chan struct{})
-		go func() {
-		    io.Copy(dst, src)
-			close(die)
-		}()
-		return die
-	}
-
-	select {
-	case <-streamCopy(p1, p2):
-	case <-streamCopy(p2, p1):
-	}
-}
-
-//checkError
-func checkError(err error) {
-	if err != nil {
-		log.Printf("%+v\n", err)
-		os.Exit(-1)
-	}
-}
-
-//服务中继
-func serverCmd(laddr string) error {
-	server := &rdv.Server{
-		Handler: handler{},
-		Logger:  slog.Default(),
-	}
-	server.Start()
-	defer server.Close()
-	ln, err := net.Listen("tcp", laddr)
-	if err != nil {
-		return err
-	}
-
-	httpSrv := &http.Server{Handler: server}
-	httpSrv.RegisterOnShutdown(server.Shutdown)
-
-	ctx, _ := signal.NotifyContext(context.Background(), os.Interrupt)
-	context.AfterFunc(ctx, func() {
-		httpSrv.Close()
-	})
-	slog.Info("listening", "addr", laddr)
-	return httpSrv.Serve(ln)
-}
-
-//handler
-type handler struct{}
-
-//Serve
-func (h handler) Serve(ctx context.Context, dc, ac *rdv.Conn) {
-	r := new(rdv.Relayer)
-	t0 := time.Now()
-	err := r.Continue(ctx, dc, ac)
-	dur := time.Since(t0).Round(time.Millisecond) // reduce noise with ms
-	slog.Info("continue", "token", dc.Token, "dur", dur, "err", err)
-	if err != nil {
-		return
-	}
-	dn, an, err := r.Relay(ctx, ac, dc, dc, ac)
-	slog.Info("relay", "token", dc.Token, "dial_bytes", dn, "accept_bytes", an, "err", err)
-}
-
-
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"time"
+	"io"
+	"strings"
+	"github.com/xtaci/smux"
+	"github.com/betamos/rdv"
+)
+
+var (
+	flagVerbose bool
+	flagWait    bool
+	flagSpaces  string
+	flagLAddr   string
+	remoteAddr   string
+	localAddr   string
+	
+	token   string
+	model   string
+	relayAddr string
+	relayAddrs []string
+	isServer = false
+	pingInterval = 3
+
+	flagRelayIdle     time.Duration
+	flagRelayMaxDur   time.Duration
+	flagRelayMaxBytes int64
+	flagRelayBuf      int
+
+	flagProxy           string
+	flagTrustedProxies  string
+	flagProxyPortHeader string
+
+	flagTLSCert     string
+	flagTLSKey      string
+	flagTLSClientCA string
+	flagRdvCA       string
+	flagRdvPin      string
+	flagRdvCert     string
+	flagRdvKey      string
+	flagRdvProxy    string
+	flagRdvSelect   string
+
+	flagFwdIdle time.Duration
+	flagFwdMaxLife time.Duration
+	flagKeepAlive  time.Duration
+	flagDrain   time.Duration
+	flagTunnels string
+	flagPool    int
+	flagServeStdio bool
+	flagCompress string
+	flagAllow    string
+	flagDeny     string
+	flagTargetAllow string
+	flagTargetProxy string
+	flagControl     string
+	flagRetries     int
+	flagRetryMax    time.Duration
+	flagAccessLog   string
+
+	flagSmuxVersion   int
+	flagSmuxRecvBuf   int
+	flagSmuxStreamBuf int
+	flagSmuxFrame     int
+
+	flagClusterSelf   string
+	flagClusterNodes  string
+	flagClusterSecret string
+	flagClusterCA     string
+	flagClusterCert   string
+	flagClusterKey    string
+	flagClusterHTTP   bool
+	flagLobbyTimeout  time.Duration
+)
+
+func usage() {
+	flag.PrintDefaults()
+}
+
+func init() {
+	flag.Usage = usage
+	
+	flag.StringVar(&flagSpaces, "s", "default", "client: enabled addr spaces, 'default', 'all', 'public', or 'none' (force relay) ")
+	flag.BoolVar(&flagWait, "w", false, "client: wait up to 5s for all p2p conns, for debugging")
+	flag.BoolVar(&flagVerbose, "v", false, "print verbose logs")
+	
+	flag.StringVar(&remoteAddr, "r", "192.167.1.6:3306,192.167.1.6:8485,:5678", "remote addrs")
+	flag.StringVar(&localAddr, "l", ":5002,:5003,:5004", "local addrs")
+	
+	flag.StringVar(&token, "token", "123456", "123456")
+	flag.StringVar(&model, "m", "serve", "dial、d or accept、a or serve, or stdio [tunnel] to forward stdin and stdout, e.g. as an ssh ProxyCommand, or status [reconnect|repunch [session]] to query or control the -control endpoint")
+	flag.StringVar(&relayAddr, "rdv", "http://192.167.1.124:8686", "relayAddr, comma-separated for several rdv servers")
+	flag.StringVar(&flagLAddr, "addr", ":8686", "server: listening addr")
+	flag.DurationVar(&flagRelayIdle, "relay-idle", 5*time.Minute, "server: close relays idle for this long, 0 to disable")
+	flag.DurationVar(&flagRelayMaxDur, "relay-max-dur", 0, "server: max duration of a relay, 0 for no limit")
+	flag.Int64Var(&flagRelayMaxBytes, "relay-max-bytes", 0, "server: max bytes relayed per session in both directions, 0 for no limit")
+	flag.IntVar(&flagRelayBuf, "relay-buf", 0, "server: relay copy buffer size in bytes, 0 for default")
+	flag.StringVar(&flagProxy, "proxy", "none", "server: observed addrs behind a load balancer, 'none', 'proxy-protocol' or 'headers'")
+	flag.StringVar(&flagTrustedProxies, "trusted-proxies", "", "server: comma-separated CIDRs of proxies trusted by -proxy")
+	flag.StringVar(&flagProxyPortHeader, "proxy-port-header", "X-Real-Port", "server: header with the client source port, for -proxy headers")
+	flag.StringVar(&flagTLSCert, "tls-cert", "", "server: TLS certificate file, reloaded on change or SIGHUP")
+	flag.StringVar(&flagTLSKey, "tls-key", "", "server: TLS key file")
+	flag.StringVar(&flagTLSClientCA, "tls-client-ca", "", "server: require client certificates signed by this CA file")
+	flag.StringVar(&flagRdvCA, "rdv-ca", "", "client: CA file to verify an https rdv server")
+	flag.StringVar(&flagRdvPin, "rdv-pin", "", "client: comma-separated base64 sha256 pins of the rdv server public key")
+	flag.StringVar(&flagRdvCert, "rdv-cert", "", "client: certificate file for rdv servers requiring client auth")
+	flag.StringVar(&flagRdvKey, "rdv-key", "", "client: key file for -rdv-cert")
+	flag.StringVar(&flagClusterSelf, "cluster-self", "", "server: url of this node in -cluster-nodes")
+	flag.StringVar(&flagClusterNodes, "cluster-nodes", "", "server: comma-separated urls of all rdv nodes sharing the lobby")
+	flag.StringVar(&flagClusterSecret, "cluster-secret", "", "server: shared secret of the cluster nodes, or $"+clusterSecretEnv)
+	flag.StringVar(&flagClusterCA, "cluster-ca", "", "server: CA file to verify https cluster nodes")
+	flag.StringVar(&flagClusterCert, "cluster-cert", "", "server: certificate file for cluster nodes requiring client auth")
+	flag.StringVar(&flagClusterKey, "cluster-key", "", "server: key file for -cluster-cert")
+	flag.BoolVar(&flagClusterHTTP, "cluster-http", false, "server: allow http cluster nodes, which receive the secret in plaintext, only for trusted networks")
+	flag.DurationVar(&flagLobbyTimeout, "lobby-timeout", 0, "server: max time a peer waits for its partner, 0 for no limit")
+	flag.IntVar(&flagSmuxVersion, "smux-version", 2, "client: smux stream version, 2 for per-stream flow control, falls back to 1 with older peers")
+	flag.IntVar(&flagSmuxRecvBuf, "smux-recv-buf", 4194304, "client: smux session receive buffer in bytes")
+	flag.IntVar(&flagSmuxStreamBuf, "smux-stream-buf", 0, "client: smux per-stream receive window in bytes, for version 2 streams, less than -smux-recv-buf (default -smux-recv-buf/16)")
+	flag.IntVar(&flagSmuxFrame, "smux-frame", 32768, "client: max smux frame size in bytes")
+	flag.IntVar(&flagPool, "pool", 1, "client: parallel rdv conns per session, new streams use the least loaded, must match the peer")
+	flag.BoolVar(&flagServeStdio, "serve-stdio", false, "dial: keep an extra rdv conn per session waiting for relayp2p stdio runs")
+	flag.StringVar(&flagCompress, "compress", "none", "client: compression of tunnels which don't set it, 'none' or 'deflate', chosen by the accept side")
+	flag.StringVar(&flagTunnels, "tunnels", "", "client: json file of named tunnels, instead of -l or -r")
+	flag.StringVar(&flagAllow, "allow", "", "client: comma-separated source CIDRs which may connect to local listeners, for tunnels without allow (default any)")
+	flag.StringVar(&flagDeny, "deny", "", "client: comma-separated source CIDRs which may not connect to local listeners, for tunnels without deny")
+	flag.StringVar(&flagTargetAllow, "target-allow", "", "client: comma-separated CIDRs and unix:/socket/paths which the dial side may connect to (default any)")
+	flag.StringVar(&flagTargetProxy, "target-proxy", "none", "client: PROXY protocol header with the client addr sent to targets of tunnels which don't set proxy, 'none', 'v1' or 'v2'")
+	flag.DurationVar(&flagDrain, "drain", 30*time.Second, "client: max time for forwarded conns to finish upon SIGINT, SIGTERM or a SIGHUP reload")
+	flag.StringVar(&flagControl, "control", "", "client: unix:<path> or loopback addr of the status and control endpoint, see relayp2p status")
+	flag.IntVar(&flagRetries, "retries", 0, "client: stop reconnecting a session after this many consecutive failed attempts, 0 for no limit")
+	flag.DurationVar(&flagRetryMax, "retry-max", 2*time.Minute, "client: max wait between reconnect attempts, which back off exponentially with jitter from 1s")
+	flag.StringVar(&flagAccessLog, "access-log", "", "client: file of json lines with an entry per forwarded conn, reopened upon SIGHUP, '-' for stdout")
+	flag.DurationVar(&flagFwdIdle, "fwd-idle", 0, "client: close forwarded conns without traffic in either direction for this long, 0 to disable")
+	flag.DurationVar(&flagFwdMaxLife, "fwd-max-life", 0, "client: close forwarded conns open for this long, 0 for no limit")
+	flag.DurationVar(&flagKeepAlive, "keepalive", 15*time.Second, "client: tcp keepalive period of local and target conns, 0 to disable")
+	flag.StringVar(&flagRdvSelect, "rdv-select", "hash", "client: choice among several -rdv servers, 'hash' (by token) or 'rtt' (nearest to the dialer)")
+	flag.StringVar(&flagRdvProxy, "rdv-proxy", "none", "client: proxy to the rdv server, 'none', 'env' (HTTPS_PROXY etc), or an http(s)://, socks5:// or socks5h:// url")
+}
+/*
+    B:accept A:dial 
+*/
+//函数入口
+func main() {
+	var err error
+	// The mode may also be given as a command, e.g. relayp2p stdio -token office-ssh
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		model = os.Args[1]
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
+	if flagVerbose {
+		log.SetFlags(log.Lmicroseconds)
+		slog.SetLogLoggerLevel(slog.LevelDebug)
+	} else {
+		log.SetFlags(log.Ltime)
+	}
+	client := &rdv.Client{Logger: slog.Default()}
+	client.TlsConfig, err = newClientTLSConfig(flagRdvCA, flagRdvPin, flagRdvCert, flagRdvKey)
+	if err != nil {
+		slog.Error("invalid tls config", "err", err)
+		os.Exit(2)
+	}
+	client.Proxy, err = rdvProxy(flagRdvProxy)
+	if err != nil {
+		slog.Error("invalid rdv proxy", "err", err)
+		os.Exit(2)
+	}
+	switch flagRdvSelect {
+	case "hash":
+		client.Selection = rdv.SelectHash
+	case "rtt":
+		client.Selection = rdv.SelectRTT
+	default:
+		usage()
+		os.Exit(2)
+	}
+	for _, addr := range strings.Split(relayAddr, ",") {
+		relayAddrs = append(relayAddrs, strings.TrimSpace(addr))
+	}
+	if flagWait {
+		client.Picker = rdv.WaitConstant(5 * time.Second)
+	}
+	// 'all', 'public', or 'none'
+	switch flagSpaces {
+	case "default":
+	case "all":
+		client.AddrSpaces = rdv.AllSpaces
+	case "public":
+		client.AddrSpaces = rdv.PublicSpaces
+	case "none":
+		client.AddrSpaces = rdv.NoSpaces
+	default:
+		usage()
+		os.Exit(2)
+	}
+	//serve dial  accept
+	switch model {
+	case "s", "serve":
+		var proxy *proxyConfig
+		proxy, err = newProxyConfig(flagProxy, flagTrustedProxies, flagProxyPortHeader)
+		if err != nil {
+			slog.Error("invalid proxy config", "err", err)
+			os.Exit(2)
+		}
+		var tlsConf *tls.Config
+		tlsConf, err = newServerTLSConfig(flagTLSCert, flagTLSKey, flagTLSClientCA)
+		if err != nil {
+			slog.Error("invalid tls config", "err", err)
+			os.Exit(2)
+		}
+		limits := relayLimits{
+			IdleTimeout: flagRelayIdle,
+			MaxDuration: flagRelayMaxDur,
+			MaxBytes:    flagRelayMaxBytes,
+			BufferSize:  flagRelayBuf,
+		}
+		var clusterTLS *tls.Config
+		clusterTLS, err = newClientTLSConfig(flagClusterCA, "", flagClusterCert, flagClusterKey)
+		if err != nil {
+			slog.Error("invalid cluster tls config", "err", err)
+			os.Exit(2)
+		}
+		var lobby rdv.Lobby
+		lobby, err = newLobby(flagClusterSelf, flagClusterNodes, cmp.Or(flagClusterSecret, os.Getenv(clusterSecretEnv)),
+			flagClusterHTTP, clusterTLS, flagLobbyTimeout, limits)
+		if err != nil {
+			slog.Error("invalid cluster config", "err", err)
+			os.Exit(2)
+		}
+		err = serverCmd(flagLAddr, proxy, tlsConf, lobby, flagLobbyTimeout, limits)
+	case "d", "dial", "a", "accept":
+	    isServer = model == "a" || model == "accept"
+	    method := rdv.DIAL
+	    if isServer {
+	        method = rdv.ACCEPT
+	    }
+	    smuxConfig, err := newSmuxConfig()
+	    if err != nil {
+	        slog.Error("invalid smux config", "err", err)
+	        os.Exit(2)
+	    }
+	    if flagPool < 1 || flagRetries < 0 || flagRetryMax < retryMin || !validCompression(flagCompress) || !validProxyHeader(flagTargetProxy) {
+	        usage()
+	        os.Exit(2)
+	    }
+	    tunnels, err := clientTunnels(isServer)
+	    if err != nil {
+	        slog.Error("invalid tunnel config", "err", err)
+	        os.Exit(2)
+	    }
+	    targetAllow, err = parseTargetAllow(splitList(flagTargetAllow))
+	    if err != nil {
+	        slog.Error("invalid acl", "err", err)
+	        os.Exit(2)
+	    }
+	    if flagAccessLog != "" {
+	        streamLog, err = openAccessLog(flagAccessLog)
+	        if err != nil {
+	            slog.Error("invalid access log", "err", err)
+	            os.Exit(2)
+	        }
+	    }
+	    run := newClientRun(client, method, smuxConfig, groupTunnels(tunnels, token, flagPool, !isServer && flagServeStdio))
+	    var control net.Listener
+	    if flagControl != "" {
+	        control, err = listenControl(flagControl)
+	        if err != nil {
+	            slog.Error("invalid control endpoint", "err", err)
+	            os.Exit(2)
+	        }
+	    }
+	    if err := run.start(); err != nil {
+	        slog.Error("an error occurred", "err", err)
+	        os.Exit(1)
+	    }
+	    if control != nil {
+	        go run.serveControl(control)
+	    }
+	    err = serveClient(run)
+	    if control != nil {
+	        control.Close()
+	    }
+	    if err != nil {
+	        slog.Error("an error occurred", "err", err)
+	        os.Exit(1)
+	    }
+	case "stdio":
+	    if !flagVerbose {
+	        // Keep ssh quiet
+	        slog.SetLogLoggerLevel(slog.LevelWarn)
+	    }
+	    smuxConfig, err := newSmuxConfig()
+	    if err != nil {
+	        slog.Error("invalid smux config", "err", err)
+	        os.Exit(2)
+	    }
+	    name := cmp.Or(flag.Arg(0), "0")
+	    tunnels := []*tunnel{{Name: name}}
+	    if flagTunnels != "" {
+	        tunnels, err = loadTunnels(flagTunnels)
+	        if err != nil {
+	            slog.Error("invalid tunnel config", "err", err)
+	            os.Exit(2)
+	        }
+	    }
+	    g, t := findTunnel(groupTunnels(tunnels, token, 1, false), name)
+	    if t == nil || !validCompression(flagCompress) {
+	        usage()
+	        os.Exit(2)
+	    }
+	    err = stdioCmd(client, g, t, smuxConfig)
+	    if err != nil {
+	        slog.Error("an error occurred", "err", err)
+	        os.Exit(1)
+	    }
+	case "status":
+	    if flagControl == "" {
+	        usage()
+	        os.Exit(2)
+	    }
+	    if err := statusCmd(flagControl, flag.Args()); err != nil {
+	        slog.Error("an error occurred", "err", err)
+	        os.Exit(1)
+	    }
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+// Connects a pooled conn of the group to the peer, and reconnects whenever the session fails,
+// until the context is canceled. Failures are retried with backoff, see classifyFailure, and
+// returned once permanent or after -retries consecutive failed attempts.
+func clientCmd(ctx context.Context, client *rdv.Client, g *sessionGroup, member int, method string, smuxConfig *smux.Config) error {
+	st := &g.status[member]
+	b := backoff{min: retryMin, max: flagRetryMax}
+	failures := 0
+	for ctx.Err() == nil {
+	    tStart := time.Now()
+    	conn, resp, err := client.DoAny(ctx, method, relayAddrs, g.memberToken(member), nil)
+    	if err != nil {
+    	    if ctx.Err() != nil {
+    	        break
+    	    }
+    	    kind, err := classifyFailure(resp, err)
+    	    if kind == failPermanent {
+    	        st.stopped(err)
+    	        return fmt.Errorf("giving up: %w", err)
+    	    }
+    	    if kind == failTransient {
+    	        failures++
+    	        if flagRetries > 0 && failures >= flagRetries {
+    	            st.stopped(err)
+    	            return fmt.Errorf("giving up after %d attempts: %w", failures, err)
+    	        }
+    	    }
+    	    wait := b.next()
+    	    fmt.Printf("Error accepting connection: %v, retrying in %v\n", err, wait.Round(time.Millisecond))
+    	    st.failed(err)
+    	    sleepCtx(ctx, wait, st.kick)
+			continue
+    	}
+    	failures = 0
+    	obs := cmp.Or(conn.ObservedAddr, &netip.AddrPort{})
+    	space := rdv.AddrSpaceFrom(obs.Addr())
+    	if space != rdv.SpacePublic4 {
+    		slog.Warn("client: expected observed to be public ipv4 (check server config)", "addr", conn.ObservedAddr)
+    	}
+    	var tConnected = time.Now()
+    	slog.Info("client: peer connected", "is_relay", conn.IsRelay, "addr", conn.RemoteAddr(), "dur", tConnected.Sub(tStart))
+    	
+    	// stream multiplex
+    	cc := &countingConn{Conn: conn}
+    	var smuxSession *smux.Session
+    	if isServer {
+    	    // 一个连接通道，分多个连接对接 本地 Accept
+    		smuxSession, err = smux.Server(cc, smuxConfig)
+    		checkError(err)
+    	} else {
+    	    // 一个连接通道，分多个连接对接 本地 dial
+    		smuxSession, err = smux.Client(cc, smuxConfig)
+    		checkError(err)
+    	}
+    	g.members[member].Store(smuxSession)
+    	st.connected(conn, cc)
+    	if ctx.Err() != nil {
+    	    // Drained while connecting, see drainGroups
+    	    smuxSession.Close()
+    	}
+    	if isServer {
+    		// The peer doesn't open streams, so this returns once the session has failed
+    		_, err = smuxSession.AcceptStream()
+    		log.Println("p2p session closed:", g.memberToken(member), err)
+    	} else {
+    	    err = handleTargetTcp(g, smuxSession, !flagVerbose)
+    	}
+    	g.members[member].CompareAndSwap(smuxSession, nil)
+    	smuxSession.Close()
+    	st.failed(err)
+    	if time.Since(tConnected) < stableSession && !stdioDone(g, member, smuxSession) {
+    	    // E.g. the conn keeps failing right away, which shouldn't hammer the rdv server
+    	    sleepCtx(ctx, b.next(), st.kick)
+    	} else {
+    	    b.reset()
+    	}
+	}
+	return nil
+}
+
+//handleTargetTcp
+func handleTargetTcp(g *sessionGroup, session *smux.Session, quiet bool) error {
+	for {
+		p1, err := session.AcceptStream()
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		meta, err := acceptedMeta(p1)
+		if err != nil {
+			p1.Close()
+			log.Println("bad stream meta:", err)
+			continue
+		}
+		t := g.tunnel(meta.Service)
+		if t == nil {
+			p1.Close()
+			log.Println("unknown tunnel:", meta.Service, "session", g.name)
+			continue
+		}
+		entry := &accessEntry{Time: time.Now(), Mode: rdv.DIAL, Tunnel: t.Name, Session: g.name, Client: meta.Source,
+			Target: t.Target, Stream: p1.ID(), IsRelay: g.relayed(session)}
+		if t.Weight > 0 {
+			p1.SetWeight(t.Weight)
+		}
+		var rwc io.ReadWriteCloser = p1
+		var cc *compressConn
+		switch meta.Compress {
+		case "":
+		case compressDeflate:
+			cc = newCompressConn(p1)
+			rwc = cc
+		default:
+			p1.Close()
+			log.Println("unsupported compression:", meta.Compress, "tunnel", t.Name)
+			continue
+		}
+		//打洞成功之后，使用 tcp 通信，， 做一个标识，网卡ip，key 指定转发，
+		p2, err := dialEndpoint(t)
+		if errors.Is(err, errTargetDenied) {
+			p1.Close()
+			slog.Warn("client: target denied", "tunnel", t.Name, "source", meta.Source, "err", err)
+			streamLog.log(entry, closeDenied, err)
+			continue
+		} else if err != nil {
+			p1.Close()
+			log.Println(err)
+			streamLog.log(entry, closeDial, err)
+			continue
+		}
+		go func() {
+			if !quiet {
+				log.Println("tcp client opened")
+				log.Println("TargetTcp " , t.Target, "tunnel", t.Name, "source", meta.Source)
+				defer log.Println("tcp client closed")
+			}
+			if v := t.proxyHeader(); v != "" {
+				// The source is as reported by the accept side, unknown for older peers
+				src, _ := netip.ParseAddrPort(meta.Source)
+				if _, err := p2.Write(appendProxyHeader(nil, v, src, addrPortFrom(p2.RemoteAddr()))); err != nil {
+					log.Println(err)
+					p1.Close()
+					p2.Close()
+					streamLog.log(entry, closeReason(session, err), err)
+					return
+				}
+			}
+			var err error
+			entry.BytesUp, entry.BytesDown, err = forward(rwc, p2, t.idleTimeout(), t.lifetimeEnd(entry.Time))
+			entry.setWire(cc)
+			streamLog.log(entry, closeReason(session, err), err)
+			if cc != nil && !quiet {
+				log.Println("compression", t.Name, cc)
+			}
+		}()
+		
+	}
+}
+
+//acceptTunnel
+func acceptTunnel(listener *tunnelListener) {
+	for {
+		p1, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			// E.g. out of fds, which may pass
+			log.Println(err)
+			time.Sleep(time.Second)
+			continue
+		}
+		b := listener.binding.Load()
+		go handleLocalTcp(b.g, b.t, p1, !flagVerbose)
+	}
+}
+
+//handleLocalTcp
+func handleLocalTcp(g *sessionGroup, t *tunnel, p1 net.Conn, quiet bool) {
+	entry := &accessEntry{Time: time.Now(), Mode: rdv.ACCEPT, Tunnel: t.Name, Session: g.name, Client: sourceAddr(p1), Listen: p1.LocalAddr().String()}
+	if !t.permits(p1) {
+		p1.Close()
+		slog.Warn("client: connection denied", "tunnel", t.Name, "source", p1.RemoteAddr())
+		streamLog.log(entry, closeDenied, nil)
+		return
+	}
+	setKeepAlive(p1, t.keepAlive())
+	sess := g.session()
+	if sess == nil {
+		// Not connected to the peer yet
+		p1.Close()
+		streamLog.log(entry, closeNoSession, nil)
+		return
+	}
+	meta := streamMeta{Service: t.Name, Source: entry.Client, Compress: t.compression()}
+	if !quiet {
+		log.Println("stream opened", t.Name, meta.Source)
+		defer log.Println("stream closed")
+	}
+	p2, err := openStream(sess, meta)
+	if err != nil {
+		p1.Close()
+		streamLog.log(entry, closeNoSession, err)
+		return
+	}
+	entry.Stream, entry.IsRelay = p2.ID(), g.relayed(sess)
+	if t.Weight > 0 {
+		p2.SetWeight(t.Weight)
+	}
+	rwc, cc := compressOpened(p2, meta)
+	entry.BytesUp, entry.BytesDown, err = forward(p1, rwc, t.idleTimeout(), t.lifetimeEnd(entry.Time))
+	entry.setWire(cc)
+	streamLog.log(entry, closeReason(sess, err), err)
+	if cc != nil && !quiet {
+		log.Println("compression", t.Name, cc)
+	}
+}
+
+// Returns the smux config of client sessions. Version 1 framing is kept for the session, so that
+// older peers interoperate, and the stream version is negotiated.
+func newSmuxConfig() (*smux.Config, error) {
+	conf := smux.DefaultConfig()
+	conf.KeepAliveInterval = time.Duration(pingInterval) * time.Second
+	conf.KeepAliveTimeout = time.Duration(pingInterval) * time.Second * 3
+	conf.StreamVersion = flagSmuxVersion
+	conf.MaxReceiveBuffer = flagSmuxRecvBuf
+	conf.MaxStreamBuffer = flagSmuxStreamBuf
+	if conf.MaxStreamBuffer == 0 {
+		// Small enough that a few slow streams can't fill the session buffer
+		conf.MaxStreamBuffer = max(flagSmuxRecvBuf/16, 1)
+	}
+	conf.MaxFrameSize = flagSmuxFrame
+	if conf.MaxStreamBuffer >= conf.MaxReceiveBuffer {
+		return nil, fmt.Errorf("-smux-stream-buf %d must be less than -smux-recv-buf %d", conf.MaxStreamBuffer, conf.MaxReceiveBuffer)
+	}
+	return conf, smux.VerifyConfig(conf)
+}
+
+//checkError
+func checkError(err error) {
+	if err != nil {
+		log.Printf("%+v\n", err)
+		os.Exit(-1)
+	}
+}
+
+//服务中继
+func serverCmd(laddr string, proxy *proxyConfig, tlsConf *tls.Config, lobby rdv.Lobby, lobbyTimeout time.Duration, limits relayLimits) error {
+	h := &handler{limits: limits, stats: newRelayStats()}
+	server := &rdv.Server{
+		Handler:          h,
+		LobbyTimeout:     lobbyTimeout,
+		Lobby:            lobby,
+		ObservedAddrFunc: proxy.observedAddrFunc(),
+		Logger:           slog.Default(),
+	}
+	server.Start()
+	defer func() {
+		server.Close()
+		slog.Info("relays ended", "by_reason", h.stats.snapshot())
+	}()
+	ln, err := net.Listen("tcp", laddr)
+	if err != nil {
+		return err
+	}
+	ln = proxy.listener(ln)
+
+	httpSrv := &http.Server{Handler: server}
+	httpSrv.RegisterOnShutdown(server.Shutdown)
+	if tlsConf != nil {
+		httpSrv.TLSConfig = tlsConf
+		// Disable h2, which doesn't support the rdv upgrade
+		httpSrv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+
+	ctx, _ := signal.NotifyContext(context.Background(), os.Interrupt)
+	context.AfterFunc(ctx, func() {
+		httpSrv.Close()
+	})
+	slog.Info("listening", "addr", laddr, "proxy", proxy.mode, "tls", tlsConf != nil, "cluster", flagClusterNodes != "")
+	if tlsConf != nil {
+		return httpSrv.ServeTLS(ln, "", "")
+	}
+	return httpSrv.Serve(ln)
+}
+
+//handler
+type handler struct {
+	limits relayLimits
+	stats  *relayStats
+}
+
+//Serve
+func (h *handler) Serve(ctx context.Context, dc, ac *rdv.Conn) {
+	r := h.limits.relayer()
+	t0 := time.Now()
+	err := r.Continue(ctx, dc, ac)
+	dur := time.Since(t0).Round(time.Millisecond) // reduce noise with ms
+	slog.Info("continue", "token", dc.Token, "dur", dur, "err", err)
+	if err != nil {
+		return
+	}
+	ctx, cancel := h.limits.context(ctx)
+	defer cancel()
+	dr, ar := h.limits.readers(dc, ac)
+	t1 := time.Now()
+	dn, an, err := r.Relay(ctx, ac, dc, dr, ar)
+	reason := endReason(err)
+	count := h.stats.add(reason)
+	dur = time.Since(t1).Round(time.Millisecond)
+	slog.Info("relay", "token", dc.Token, "dial_bytes", dn, "accept_bytes", an, "dur", dur, "reason", reason, "count", count, "err", err)
+}
+
+
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/xtaci/smux"
+)
+
+// streamMeta describes a forwarded conn to the remote side, and is sent with the smux stream.
+type streamMeta struct {
+	Service  string `json:"service,omitempty"`  // Name of the tunnel or service
+	Source   string `json:"source,omitempty"`   // Source addr of the local client
+	Compress string `json:"compress,omitempty"` // Compression of the payload, see compressConn
+}
+
+// Opens a stream with the metadata, or a plain stream if the peer doesn't support metadata.
+func openStream(sess *smux.Session, meta streamMeta) (*smux.Stream, error) {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := sess.OpenStreamWithMeta(b)
+	if errors.Is(err, smux.ErrStreamMetaUnsupported) {
+		return sess.OpenStream()
+	}
+	return stream, err
+}
+
+// Returns the metadata of an accepted stream. Streams from older peers have none.
+func acceptedMeta(stream *smux.Stream) (meta streamMeta, err error) {
+	if b := stream.Meta(); len(b) > 0 {
+		err = json.Unmarshal(b, &meta)
+	}
+	return
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// Peer credentials are only supported on linux.
+func peerCred(c *net.UnixConn) (string, error) {
+	return "", errors.ErrUnsupported
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ways for the rdv server to learn the observed addrs of clients, when behind a load balancer.
+const (
+	proxyNone     = "none"
+	proxyProtocol = "proxy-protocol"
+	proxyHeaders  = "headers"
+)
+
+// Versions of the PROXY protocol header sent to the targets of tunnels.
+const (
+	proxyV1 = "v1"
+	proxyV2 = "v2"
+)
+
+// Max time to wait for a PROXY protocol header from a trusted proxy.
+const proxyHeaderTimeout = 5 * time.Second
+
+var (
+	errProxyHeader = errors.New("invalid proxy protocol header")
+
+	// PROXY protocol v2 signature
+	proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxyConfig selects how observed addrs are extracted when running behind trusted proxies.
+type proxyConfig struct {
+	mode string
+
+	// Only conns from these prefixes may supply a PROXY header or forwarding headers.
+	trusted []netip.Prefix
+
+	// Header carrying the client source port, since X-Forwarded-For has none.
+	portHeader string
+}
+
+func newProxyConfig(mode, trusted, portHeader string) (*proxyConfig, error) {
+	c := &proxyConfig{mode: mode, portHeader: portHeader}
+	switch mode {
+	case proxyNone:
+		return c, nil
+	case proxyProtocol, proxyHeaders:
+	default:
+		return nil, fmt.Errorf("unknown proxy mode [%s]", mode)
+	}
+	for _, s := range strings.Split(trusted, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy [%s]: %w", s, err)
+		}
+		c.trusted = append(c.trusted, prefix.Masked())
+	}
+	if len(c.trusted) == 0 {
+		return nil, fmt.Errorf("proxy mode [%s] requires trusted proxies", mode)
+	}
+	return c, nil
+}
+
+// Reports whether the addr belongs to a trusted proxy.
+func (c *proxyConfig) isTrusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range c.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wraps the listener to parse PROXY headers, if enabled.
+func (c *proxyConfig) listener(ln net.Listener) net.Listener {
+	if c.mode != proxyProtocol {
+		return ln
+	}
+	return &proxyListener{ln, c}
+}
+
+// Returns a function for rdv.Server.ObservedAddrFunc, or nil to use the remote addr.
+func (c *proxyConfig) observedAddrFunc() func(r *http.Request) (netip.AddrPort, error) {
+	if c.mode != proxyHeaders {
+		return nil
+	}
+	return c.observedAddr
+}
+
+// Extracts the client addr from the forwarding headers, if the request comes from a
+// trusted proxy. The Forwarded header takes precedence over X-Forwarded-For.
+func (c *proxyConfig) observedAddr(r *http.Request) (netip.AddrPort, error) {
+	remote, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if !c.isTrusted(remote.Addr()) {
+		return remote, nil
+	}
+	hops := forwardedFor(r.Header.Values("Forwarded"))
+	if len(hops) == 0 {
+		hops = xForwardedFor(r.Header.Values("X-Forwarded-For"))
+	}
+	if len(hops) == 0 {
+		return netip.AddrPort{}, errors.New("trusted proxy sent no forwarding headers")
+	}
+	// Walk from the nearest hop, skipping our own proxies
+	client := hops[0]
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !c.isTrusted(hops[i].Addr()) {
+			client = hops[i]
+			break
+		}
+	}
+	if client.Port() != 0 {
+		return client, nil
+	}
+	portStr := r.Header.Get(c.portHeader)
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return netip.AddrPort{}, fmt.Errorf("invalid port header %s [%s]", c.portHeader, portStr)
+	}
+	return netip.AddrPortFrom(client.Addr(), uint16(port)), nil
+}
+
+// Parses the for= addrs of Forwarded headers (RFC 7239), in order. Obfuscated
+// and unknown nodes are skipped. The port is zero if not present.
+func forwardedFor(values []string) (addrs []netip.AddrPort) {
+	for _, value := range values {
+		for _, elem := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(key, "for") {
+					continue
+				}
+				if addr, ok := parseHop(strings.Trim(val, `"`)); ok {
+					addrs = append(addrs, addr)
+				}
+			}
+		}
+	}
+	return
+}
+
+// Parses X-Forwarded-For headers, in order.
+func xForwardedFor(values []string) (addrs []netip.AddrPort) {
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			if addr, ok := parseHop(strings.TrimSpace(part)); ok {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return
+}
+
+// Parses "ip", "ip:port", "[ipv6]" or "[ipv6]:port".
+func parseHop(s string) (netip.AddrPort, bool) {
+	if addr, err := netip.ParseAddrPort(s); err == nil {
+		return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port()), true
+	}
+	if addr, err := netip.ParseAddr(strings.Trim(s, "[]")); err == nil {
+		return netip.AddrPortFrom(addr.Unmap(), 0), true
+	}
+	return netip.AddrPort{}, false
+}
+
+// proxyListener accepts conns which parse a PROXY header from trusted proxies.
+type proxyListener struct {
+	net.Listener
+	cfg *proxyConfig
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	nc, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: nc, cfg: l.cfg, br: bufio.NewReader(nc)}, nil
+}
+
+// proxyConn parses the PROXY header lazily, on the first Read or RemoteAddr, in order to
+// not block the accept loop.
+type proxyConn struct {
+	net.Conn
+	cfg *proxyConfig
+	br  *bufio.Reader
+
+	once sync.Once
+	src  net.Addr // Client addr from the header, if any
+	err  error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		remote := addrPortFrom(c.Conn.RemoteAddr())
+		if !c.cfg.isTrusted(remote.Addr()) {
+			return
+		}
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		src, err := readProxyHeader(c.br)
+		c.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			slog.Debug("proxy: bad header", "addr", remote, "err", err)
+			c.err = err
+			return
+		}
+		if src.IsValid() {
+			c.src = net.TCPAddrFromAddrPort(src)
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	if c.init(); c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.init(); c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// Returns the ip:port of a net.Addr, or the zero value if not an ip addr.
+func addrPortFrom(addr net.Addr) netip.AddrPort {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.AddrPort()
+	}
+	ap, _ := netip.ParseAddrPort(addr.String())
+	return ap
+}
+
+// Reads a PROXY protocol v1 or v2 header and returns the source addr. The addr is invalid
+// for LOCAL (v2) and UNKNOWN (v1) headers, in which case the conn's own addr applies.
+func readProxyHeader(br *bufio.Reader) (netip.AddrPort, error) {
+	sig, err := br.Peek(len(proxyV2Sig))
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if bytes.Equal(sig, proxyV2Sig) {
+		return readProxyV2(br)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyV1(br)
+	}
+	return netip.AddrPort{}, fmt.Errorf("%w: missing signature", errProxyHeader)
+}
+
+// Reads a v1 header, e.g. "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func readProxyV1(br *bufio.Reader) (netip.AddrPort, error) {
+	// The longest v1 header is 107 bytes, well within the bufio buffer
+	line, err := br.ReadSlice('\n')
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return netip.AddrPort{}, fmt.Errorf("%w: malformed v1 line", errProxyHeader)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return netip.AddrPort{}, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return netip.AddrPort{}, fmt.Errorf("%w: malformed v1 line", errProxyHeader)
+	}
+	src, err := parseProxyV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if _, err := parseProxyV1Addr(fields[1], fields[3], fields[5]); err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(src.Addr().Unmap(), src.Port()), nil
+}
+
+// Parses an addr and port of a v1 line, whose family must match the protocol, TCP4 or TCP6.
+func parseProxyV1Addr(proto, addrStr, portStr string) (netip.AddrPort, error) {
+	addr, err := netip.ParseAddr(addrStr)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("%w: %v", errProxyHeader, err)
+	}
+	if (proto == "TCP4") != addr.Is4() || addr.Zone() != "" {
+		return netip.AddrPort{}, fmt.Errorf("%w: %s addr [%s]", errProxyHeader, proto, addrStr)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("%w: %v", errProxyHeader, err)
+	}
+	return netip.AddrPortFrom(addr, uint16(port)), nil
+}
+
+// Reads a binary v2 header, see https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+func readProxyV2(br *bufio.Reader) (netip.AddrPort, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return netip.AddrPort{}, err
+	}
+	verCmd, fam := hdr[12], hdr[13]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if verCmd>>4 != 2 {
+		return netip.AddrPort{}, fmt.Errorf("%w: bad version", errProxyHeader)
+	}
+	switch verCmd & 0xf {
+	case 0x0: // LOCAL, e.g. health checks
+		return netip.AddrPort{}, nil
+	case 0x1: // PROXY
+	default:
+		return netip.AddrPort{}, fmt.Errorf("%w: bad command", errProxyHeader)
+	}
+	var ipLen int
+	switch fam >> 4 {
+	case 0x1: // AF_INET
+		ipLen = 4
+	case 0x2: // AF_INET6
+		ipLen = 16
+	default: // Unspecified or unix, TLVs are ignored
+		return netip.AddrPort{}, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return netip.AddrPort{}, fmt.Errorf("%w: short addrs", errProxyHeader)
+	}
+	addr, _ := netip.AddrFromSlice(body[:ipLen])
+	port := binary.BigEndian.Uint16(body[2*ipLen:])
+	return netip.AddrPortFrom(addr.Unmap(), port), nil
+}
+
+// Appends a PROXY protocol header of the version, "v1" or "v2", for a conn from src to dst.
+// Without ip addrs, e.g. for a unix socket client, the header is UNKNOWN (v1) or LOCAL (v2),
+// which tells the receiver to use the conn's own addrs.
+func appendProxyHeader(b []byte, version string, src, dst netip.AddrPort) []byte {
+	src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+	dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	known := src.IsValid() && dst.IsValid()
+	ipv4 := src.Addr().Is4() && dst.Addr().Is4()
+	if version == proxyV1 {
+		switch {
+		case !known:
+			return append(b, "PROXY UNKNOWN\r\n"...)
+		case ipv4:
+			return fmt.Appendf(b, "PROXY TCP4 %s %s %d %d\r\n", src.Addr(), dst.Addr(), src.Port(), dst.Port())
+		}
+		return fmt.Appendf(b, "PROXY TCP6 %s %s %d %d\r\n", as16(src.Addr()), as16(dst.Addr()), src.Port(), dst.Port())
+	}
+	b = append(b, proxyV2Sig...)
+	switch {
+	case !known:
+		return append(b, 0x20, 0x00, 0, 0) // LOCAL, unspecified
+	case ipv4:
+		b = append(b, 0x21, 0x11, 0, 12) // PROXY, AF_INET over TCP
+		b = append(b, src.Addr().AsSlice()...)
+		b = append(b, dst.Addr().AsSlice()...)
+	default:
+		b = append(b, 0x21, 0x21, 0, 36) // PROXY, AF_INET6 over TCP
+		b = append(b, as16(src.Addr()).AsSlice()...)
+		b = append(b, as16(dst.Addr()).AsSlice()...)
+	}
+	b = binary.BigEndian.AppendUint16(b, src.Port())
+	return binary.BigEndian.AppendUint16(b, dst.Port())
+}
+
+// Returns the addr in its IPv6 form, with IPv4 addrs mapped, to pair it with an IPv6 addr.
+func as16(addr netip.Addr) netip.Addr {
+	return netip.AddrFrom16(addr.As16())
+}
+
+// Returns a function for rdv.Client.Proxy: "none" or empty for direct conns, the default, "env"
+// for the HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables, or else a proxy url.
+func rdvProxy(s string) (func(*http.Request) (*url.URL, error), error) {
+	switch s {
+	case "env":
+		return http.ProxyFromEnvironment, nil
+	case "", "none":
+		return nil, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme [%s]", u.Scheme)
+	}
+	return http.ProxyURL(u), nil
+}
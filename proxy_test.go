@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func readHeader(b []byte) (netip.AddrPort, error) {
+	return readProxyHeader(bufio.NewReader(bytes.NewReader(b)))
+}
+
+func TestReadProxyV1(t *testing.T) {
+	for _, c := range []struct {
+		line   string
+		expect string // Empty for an invalid addr
+		ok     bool
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324", true},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", true},
+		{"PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 56324 443\r\n", "192.0.2.1:56324", true},
+		{"PROXY UNKNOWN\r\n", "", true},
+		{"PROXY UNKNOWN 192.0.2.1 198.51.100.1 56324 443\r\n", "", true},
+		// Wrong family
+		{"PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n", "", false},
+		{"PROXY TCP4 ::ffff:192.0.2.1 198.51.100.1 56324 443\r\n", "", false},
+		{"PROXY TCP6 192.0.2.1 198.51.100.1 56324 443\r\n", "", false},
+		{"PROXY TCP4 192.0.2.1 2001:db8::2 56324 443\r\n", "", false},
+		{"PROXY TCP6 2001:db8::1 198.51.100.1 56324 443\r\n", "", false},
+		// Malformed
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n", "", false},
+		{"PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 http\r\n", "", false},
+		{"PROXY TCP4 192.0.2.x 198.51.100.1 56324 443\r\n", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443 " + strings.Repeat(" ", 80) + "\r\n", "", false},
+		// Truncated
+		{"PROXY TCP4 192.0.2.1 198.51.100.1", "", false},
+		{"PROXY", "", false},
+	} {
+		addr, err := readHeader([]byte(c.line))
+		if (err == nil) != c.ok {
+			t.Errorf("%q: expected ok %v, got %v", c.line, c.ok, err)
+			continue
+		}
+		if c.ok && c.expect == "" && addr.IsValid() {
+			t.Errorf("%q: expected no addr, got %v", c.line, addr)
+		} else if c.expect != "" && addr.String() != c.expect {
+			t.Errorf("%q: expected %s, got %v", c.line, c.expect, addr)
+		}
+	}
+}
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	for _, c := range []struct {
+		src, dst string
+	}{
+		{"192.0.2.1:56324", "198.51.100.1:443"},
+		{"[2001:db8::1]:56324", "[2001:db8::2]:443"},
+		{"192.0.2.1:56324", "[2001:db8::2]:443"},
+		{"[2001:db8::1]:56324", "198.51.100.1:443"},
+	} {
+		src, dst := netip.MustParseAddrPort(c.src), netip.MustParseAddrPort(c.dst)
+		for _, version := range []string{proxyV1, proxyV2} {
+			b := appendProxyHeader(nil, version, src, dst)
+			b = append(b, "payload"...)
+			br := bufio.NewReader(bytes.NewReader(b))
+			addr, err := readProxyHeader(br)
+			if err != nil || addr != src {
+				t.Errorf("%s %s: expected %v, got %v, %v", version, c.src, src, addr, err)
+				continue
+			}
+			if rest, _ := io.ReadAll(br); string(rest) != "payload" {
+				t.Errorf("%s %s: expected the payload after the header, got %q", version, c.src, rest)
+			}
+		}
+	}
+	// Without ip addrs, e.g. from a unix socket
+	for _, version := range []string{proxyV1, proxyV2} {
+		b := appendProxyHeader(nil, version, netip.AddrPort{}, netip.MustParseAddrPort("192.0.2.1:22"))
+		if addr, err := readHeader(b); err != nil || addr.IsValid() {
+			t.Errorf("%s unknown: expected no addr, got %v, %v", version, addr, err)
+		}
+	}
+}
+
+func TestReadProxyV2Malformed(t *testing.T) {
+	src, dst := netip.MustParseAddrPort("192.0.2.1:56324"), netip.MustParseAddrPort("198.51.100.1:443")
+	valid := appendProxyHeader(nil, proxyV2, src, dst)
+	with := func(i int, v byte) []byte {
+		b := bytes.Clone(valid)
+		b[i] = v
+		return b
+	}
+	for name, b := range map[string][]byte{
+		"truncated header": valid[:14],
+		"truncated addrs":  valid[:len(valid)-3],
+		"bad version":      with(12, 0x31),
+		"bad command":      with(12, 0x22),
+		"short addrs":      append(with(15, 4), 0, 0, 0, 0)[:20],
+		"ipv6 in ipv4 len": with(13, 0x21),
+		"missing sig":      with(0, 'x'),
+	} {
+		if addr, err := readHeader(b); err == nil {
+			t.Errorf("%s: expected an error, got %v", name, addr)
+		}
+	}
+	// Unix sockets carry no ip addrs, so the conn's own addr applies
+	unix := append(bytes.Clone(proxyV2Sig), 0x21, 0x31, 0, 216)
+	unix = append(unix, make([]byte, 216)...)
+	if addr, err := readHeader(unix); err != nil || addr.IsValid() {
+		t.Errorf("unix: expected no addr, got %v, %v", addr, err)
+	}
+}
+
+// Connects to a proxy listener over loopback, sends the data, and returns the accepted conn.
+func testProxyConn(t *testing.T, trusted string, data []byte) net.Conn {
+	cfg, err := newProxyConfig(proxyProtocol, trusted, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	ln = cfg.listener(ln)
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.Write(data)
+	c.(*net.TCPConn).CloseWrite()
+	nc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { nc.Close() })
+	return nc
+}
+
+func TestProxyConn(t *testing.T) {
+	src, dst := netip.MustParseAddrPort("192.0.2.1:56324"), netip.MustParseAddrPort("198.51.100.1:443")
+	data := append(appendProxyHeader(nil, proxyV1, src, dst), "payload"...)
+
+	nc := testProxyConn(t, "127.0.0.0/8", data)
+	if got := addrPortFrom(nc.RemoteAddr()); got != src {
+		t.Errorf("trusted: expected %v, got %v", src, got)
+	}
+	if rest, _ := io.ReadAll(nc); string(rest) != "payload" {
+		t.Errorf("trusted: expected the payload, got %q", rest)
+	}
+
+	// The header of an untrusted source is left as data
+	nc = testProxyConn(t, "10.0.0.0/8", data)
+	if got := addrPortFrom(nc.RemoteAddr()); got == src || !got.Addr().IsLoopback() {
+		t.Errorf("untrusted: expected the loopback addr, got %v", got)
+	}
+	if rest, _ := io.ReadAll(nc); !bytes.Equal(rest, data) {
+		t.Errorf("untrusted: expected the raw data, got %q", rest)
+	}
+
+	// A trusted source without a header fails
+	nc = testProxyConn(t, "127.0.0.0/8", []byte("GET / HTTP/1.1\r\n\r\n"))
+	if _, err := nc.Read(make([]byte, 1)); !errors.Is(err, errProxyHeader) {
+		t.Errorf("no header: expected %v, got %v", errProxyHeader, err)
+	}
+}
+
+func TestObservedAddr(t *testing.T) {
+	cfg, err := newProxyConfig(proxyHeaders, "10.0.0.0/8, 2001:db8:ffff::/48", "X-Real-Port")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name   string
+		remote string
+		header http.Header
+		expect string // Empty for an error
+	}{
+		{"untrusted", "192.0.2.9:1234", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "192.0.2.9:1234"},
+		{"xff", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1"}, "X-Real-Port": {"5555"}}, "198.51.100.1:5555"},
+		{"xff skips trusted hops", "10.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"203.0.113.7, 198.51.100.1", "10.0.0.2"}, "X-Real-Port": {"5555"}}, "198.51.100.1:5555"},
+		{"xff spoofed first hop", "10.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"10.0.0.3, 198.51.100.1, 10.0.0.2"}, "X-Real-Port": {"5555"}}, "198.51.100.1:5555"},
+		{"xff all trusted", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}, "X-Real-Port": {"5555"}}, "10.0.0.3:5555"},
+		{"xff without port", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, ""},
+		{"xff bad port", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1"}, "X-Real-Port": {"0"}}, ""},
+		{"xff with port", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1:4711"}}, "198.51.100.1:4711"},
+		{"forwarded", "10.0.0.1:1234", http.Header{"Forwarded": {`for="[2001:db8::1]:4711";proto=https, for=10.0.0.2`}},
+			"[2001:db8::1]:4711"},
+		{"forwarded takes precedence", "10.0.0.1:1234",
+			http.Header{"Forwarded": {"for=198.51.100.1:4711"}, "X-Forwarded-For": {"203.0.113.7:80"}}, "198.51.100.1:4711"},
+		{"forwarded obfuscated", "10.0.0.1:1234",
+			http.Header{"Forwarded": {"for=_hidden, for=unknown"}, "X-Forwarded-For": {"203.0.113.7:80"}}, "203.0.113.7:80"},
+		{"trusted ipv6 proxy", "[2001:db8:ffff::1]:1234", http.Header{"X-Forwarded-For": {"198.51.100.1:4711"}}, "198.51.100.1:4711"},
+		{"mapped ipv4 hop", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"[::ffff:198.51.100.1]:4711"}}, "198.51.100.1:4711"},
+		{"no headers", "10.0.0.1:1234", http.Header{}, ""},
+	} {
+		r := &http.Request{RemoteAddr: c.remote, Header: c.header}
+		addr, err := cfg.observedAddr(r)
+		if c.expect == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", c.name, addr)
+			}
+		} else if err != nil || addr.String() != c.expect {
+			t.Errorf("%s: expected %s, got %v, %v", c.name, c.expect, addr, err)
+		}
+	}
+}
+
+func TestNewProxyConfig(t *testing.T) {
+	for _, c := range []struct {
+		mode, trusted string
+		ok            bool
+	}{
+		{proxyNone, "", true},
+		{proxyHeaders, "10.0.0.0/8", true},
+		{proxyProtocol, "10.0.0.1/8, ::1/128", true},
+		{proxyHeaders, "", false},
+		{proxyProtocol, "10.0.0.1", false},
+		{"other", "10.0.0.0/8", false},
+	} {
+		if _, err := newProxyConfig(c.mode, c.trusted, ""); (err == nil) != c.ok {
+			t.Errorf("%s %q: expected ok %v, got %v", c.mode, c.trusted, c.ok, err)
+		}
+	}
+}
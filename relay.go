@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/betamos/rdv"
+)
+
+// Reasons a relay has ended, as logged and counted by the server.
+const (
+	reasonEOF         = "eof"
+	reasonIdle        = "idle"
+	reasonMaxDuration = "max-duration"
+	reasonQuota       = "quota"
+	reasonShutdown    = "shutdown"
+	reasonError       = "error"
+)
+
+var (
+	errMaxDuration = errors.New("relay max duration reached")
+	errQuota       = errors.New("relay byte quota exceeded")
+)
+
+// relayLimits bounds a single relay between two peers. Zero values mean no limit.
+type relayLimits struct {
+	// Close the relay after this long without traffic in either direction.
+	IdleTimeout time.Duration
+
+	// Close the relay after this long, regardless of traffic.
+	MaxDuration time.Duration
+
+	// Close the relay once this many bytes have been relayed, in both directions combined.
+	MaxBytes int64
+
+	// Size of the copy buffers, by default the io.Copy size.
+	BufferSize int
+}
+
+// Returns a relayer with the idle timeout and buffer size.
+func (l relayLimits) relayer() *rdv.Relayer {
+	return &rdv.Relayer{
+		IdleTimeout: l.IdleTimeout,
+		BufferSize:  l.BufferSize,
+	}
+}
+
+// Returns a ctx which is canceled with errMaxDuration once the max duration expires.
+func (l relayLimits) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if l.MaxDuration <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeoutCause(ctx, l.MaxDuration, errMaxDuration)
+}
+
+// Returns readers for the dial and accept conns, which share the byte quota, if any.
+func (l relayLimits) readers(dc, ac io.Reader) (io.Reader, io.Reader) {
+	if l.MaxBytes <= 0 {
+		return dc, ac
+	}
+	used := new(atomic.Int64)
+	return &quotaReader{dc, used, l.MaxBytes}, &quotaReader{ac, used, l.MaxBytes}
+}
+
+// quotaReader fails with errQuota once the shared byte budget is spent.
+type quotaReader struct {
+	r    io.Reader
+	used *atomic.Int64
+	max  int64
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	left := q.max - q.used.Load()
+	if left <= 0 {
+		return 0, errQuota
+	}
+	if int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err := q.r.Read(p)
+	q.used.Add(int64(n))
+	return n, err
+}
+
+// Maps the error returned by rdv.Relayer.Relay to the reason the relay ended.
+func endReason(err error) string {
+	switch {
+	case errors.Is(err, io.EOF):
+		return reasonEOF
+	case errors.Is(err, errMaxDuration):
+		return reasonMaxDuration
+	case errors.Is(err, errQuota):
+		return reasonQuota
+	case errors.Is(err, http.ErrServerClosed):
+		return reasonShutdown
+	case errors.Is(err, context.DeadlineExceeded):
+		// The relayer's idle timer cancels with DeadlineExceeded
+		return reasonIdle
+	}
+	return reasonError
+}
+
+// relayStats counts ended relays by reason.
+type relayStats struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func newRelayStats() *relayStats {
+	return &relayStats{counts: make(map[string]int64)}
+}
+
+// Counts a relay that ended for the reason, and returns the new count.
+func (s *relayStats) add(reason string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts[reason]++
+	return s.counts[reason]
+}
+
+func (s *relayStats) snapshot() map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.counts)
+}
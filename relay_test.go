@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuotaReader(t *testing.T) {
+	l := relayLimits{MaxBytes: 10}
+	dr, ar := l.readers(strings.NewReader("abcdefgh"), strings.NewReader("12345678"))
+	buf := make([]byte, 6)
+	if n, err := dr.Read(buf); n != 6 || err != nil {
+		t.Fatalf("expected 6 bytes, got %d, %v", n, err)
+	}
+	// The budget is shared, so the accept side only has 4 bytes left
+	if n, err := ar.Read(buf); n != 4 || err != nil || string(buf[:n]) != "1234" {
+		t.Fatalf("expected the 4 bytes left, got %q, %v", buf[:n], err)
+	}
+	for _, r := range []io.Reader{dr, ar} {
+		if n, err := r.Read(buf); n != 0 || !errors.Is(err, errQuota) {
+			t.Errorf("expected %v, got %d, %v", errQuota, n, err)
+		}
+	}
+
+	// Without a quota, the readers are used as is
+	src := strings.NewReader("data")
+	if dr, _ := (relayLimits{}).readers(src, src); dr != io.Reader(src) {
+		t.Errorf("expected the reader itself without a quota")
+	}
+}
+
+// Traffic from the dial side during testRelay.
+const (
+	trafficRequest = iota // A request, and then EOF
+	trafficSteady         // Until the relay ends
+	trafficNone           // Open without traffic
+)
+
+// Relays between two pipes with the limits, and returns the reason the relay ended.
+func testRelay(t *testing.T, l relayLimits, traffic int) string {
+	d, dRelay := net.Pipe()
+	a, aRelay := net.Pipe()
+	defer d.Close()
+	defer a.Close()
+	go io.Copy(io.Discard, a)
+	go io.Copy(io.Discard, d)
+	switch traffic {
+	case trafficRequest:
+		go func() {
+			d.Write([]byte("request"))
+			d.Close()
+		}()
+	case trafficSteady:
+		go func() {
+			for {
+				if _, err := d.Write(bytes.Repeat([]byte("x"), 100)); err != nil {
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}()
+	}
+	ctx, cancel := l.context(context.Background())
+	defer cancel()
+	dr, ar := l.readers(dRelay, aRelay)
+	done := make(chan string, 1)
+	go func() {
+		_, _, err := l.relayer().Relay(ctx, aRelay, dRelay, dr, ar)
+		done <- endReason(err)
+	}()
+	select {
+	case reason := <-done:
+		return reason
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the relay to end")
+	}
+	return ""
+}
+
+func TestRelayLimits(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		limits  relayLimits
+		traffic int
+		expect  string
+	}{
+		{"eof", relayLimits{MaxBytes: 1000, MaxDuration: time.Minute}, trafficRequest, reasonEOF},
+		{"quota", relayLimits{MaxBytes: 1000}, trafficSteady, reasonQuota},
+		{"max duration", relayLimits{MaxDuration: 100 * time.Millisecond}, trafficSteady, reasonMaxDuration},
+		{"idle", relayLimits{IdleTimeout: 100 * time.Millisecond, MaxDuration: time.Minute}, trafficNone, reasonIdle},
+		{"traffic isn't idle", relayLimits{IdleTimeout: 100 * time.Millisecond, MaxDuration: 300 * time.Millisecond},
+			trafficSteady, reasonMaxDuration},
+	} {
+		if got := testRelay(t, c.limits, c.traffic); got != c.expect {
+			t.Errorf("%s: expected %s, got %s", c.name, c.expect, got)
+		}
+	}
+}
+
+func TestEndReason(t *testing.T) {
+	for _, c := range []struct {
+		err    error
+		expect string
+	}{
+		{io.EOF, reasonEOF},
+		{errMaxDuration, reasonMaxDuration},
+		{errQuota, reasonQuota},
+		{fmt.Errorf("read: %w", errQuota), reasonQuota},
+		{http.ErrServerClosed, reasonShutdown},
+		{context.DeadlineExceeded, reasonIdle},
+		{context.Canceled, reasonError},
+		{errors.New("other"), reasonError},
+	} {
+		if got := endReason(c.err); got != c.expect {
+			t.Errorf("%v: expected %s, got %s", c.err, c.expect, got)
+		}
+	}
+}
+
+func TestRelayStats(t *testing.T) {
+	s := newRelayStats()
+	s.add(reasonEOF)
+	if n := s.add(reasonEOF); n != 2 {
+		t.Errorf("expected a count of 2, got %d", n)
+	}
+	s.add(reasonQuota)
+	snap := s.snapshot()
+	s.add(reasonQuota)
+	if snap[reasonEOF] != 2 || snap[reasonQuota] != 1 {
+		t.Errorf("expected a copy of the counts, got %v", snap)
+	}
+}
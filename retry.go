@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/betamos/rdv"
+)
+
+const (
+	// First wait before reconnecting, doubled upon each consecutive failure up to -retry-max.
+	retryMin = time.Second
+
+	// A session which fails sooner than this is retried with backoff, like a failed attempt, unless
+	// a stdio run ended it, see stdioDone.
+	stableSession = 30 * time.Second
+)
+
+// How the reconnect loop handles a failed rdv request, see classifyFailure.
+type failure int
+
+const (
+	failTransient failure = iota // Retried with backoff, e.g. network errors, 5xx or a server shutting down
+	failNoPeer                   // The peer didn't show up in time, retried with backoff without counting as an attempt
+	failPermanent                // Not retried
+)
+
+// Classifies a failed rdv request by its error and the response, if any. Permanent failures
+// include a server which doesn't speak rdv and a rejected request. Being replaced by another
+// client with the same token and mode is retried with backoff, since the other client may be a
+// restart of this one, whereas two running clients keep replacing each other at the backoff pace.
+func classifyFailure(resp *http.Response, err error) (failure, error) {
+	switch {
+	case errors.Is(err, rdv.ErrBadHandshake):
+		return failPermanent, fmt.Errorf("%w (check that -rdv is an rdv server)", err)
+	case resp == nil:
+		return failTransient, err
+	case resp.StatusCode == http.StatusRequestTimeout:
+		return failNoPeer, err
+	case resp.StatusCode == http.StatusConflict:
+		return failTransient, fmt.Errorf("%w (replaced by another client with the same token and mode)", err)
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return failTransient, err
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return failPermanent, fmt.Errorf("%w (rejected by the rdv server)", err)
+	}
+	return failTransient, err
+}
+
+// Exponential backoff with jitter, so that pooled conns and peers don't retry in lockstep.
+type backoff struct {
+	min, max time.Duration
+	attempts int // Since the last reset
+}
+
+// Returns the next wait, within the upper half of the current interval.
+func (b *backoff) next() time.Duration {
+	d := b.max
+	if b.attempts < 30 {
+		d = min(b.min<<b.attempts, b.max)
+	}
+	b.attempts++
+	return d/2 + rand.N(d/2+1)
+}
+
+func (b *backoff) reset() {
+	b.attempts = 0
+}
+
+// Waits for the duration, unless kicked or canceled first.
+func sleepCtx(ctx context.Context, d time.Duration, kick <-chan struct{}) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-kick:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/betamos/rdv"
+)
+
+func TestClassifyFailure(t *testing.T) {
+	errStatus := errors.New("bad status")
+	for _, c := range []struct {
+		name   string
+		status int // 0 for no response
+		err    error
+		expect failure
+	}{
+		{"bad handshake", 0, fmt.Errorf("wrapped: %w", rdv.ErrBadHandshake), failPermanent},
+		{"network", 0, io.ErrUnexpectedEOF, failTransient},
+		{"bad request", http.StatusBadRequest, errStatus, failPermanent},
+		{"forbidden", http.StatusForbidden, errStatus, failPermanent},
+		{"not found", http.StatusNotFound, errStatus, failPermanent},
+		{"no peer", http.StatusRequestTimeout, errStatus, failNoPeer},
+		{"replaced", http.StatusConflict, errStatus, failTransient},
+		{"rate limited", http.StatusTooManyRequests, errStatus, failTransient},
+		{"internal error", http.StatusInternalServerError, errStatus, failTransient},
+		{"shutting down", http.StatusServiceUnavailable, errStatus, failTransient},
+	} {
+		var resp *http.Response
+		if c.status != 0 {
+			resp = &http.Response{StatusCode: c.status}
+		}
+		got, err := classifyFailure(resp, c.err)
+		if got != c.expect {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expect, got)
+		}
+		if !errors.Is(err, c.err) {
+			t.Errorf("%s: expected the error to wrap %v, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := backoff{min: time.Second, max: 8 * time.Second}
+	for i, interval := range []time.Duration{1, 2, 4, 8, 8, 8} {
+		interval *= time.Second
+		if d := b.next(); d < interval/2 || d > interval {
+			t.Fatalf("attempt %d: expected a wait within [%v, %v], got %v", i, interval/2, interval, d)
+		}
+	}
+	b.reset()
+	if d := b.next(); d > time.Second {
+		t.Fatalf("expected the min wait after reset, got %v", d)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/betamos/rdv"
+	"github.com/xtaci/smux"
+)
+
+// Interval of checking the -tunnels file for changes, in addition to SIGHUP.
+const tunnelsPollInterval = 10 * time.Second
+
+// A run of the dial or accept side: the sessions of the tunnel groups, each with a pool of rdv
+// conns, and the local listeners of the accept side.
+type clientRun struct {
+	client     *rdv.Client
+	method     string
+	smuxConfig *smux.Config
+
+	mu        sync.Mutex // Guards groups, which are replaced by a reload, for the control endpoint
+	groups    []*sessionGroup
+	listeners map[string][]*tunnelListener // By tunnel name
+	wg        sync.WaitGroup
+	started   time.Time
+
+	live    atomic.Int64 // Running pooled conns, see startGroup
+	stopped chan error   // Once no pooled conn is left, due to failures
+}
+
+// A local listener of a tunnel. A reload which keeps the addr keeps the listener open, and only
+// updates the tunnel, which applies to conns accepted afterwards.
+type tunnelListener struct {
+	net.Listener
+	addr    string
+	binding atomic.Pointer[tunnelBinding]
+}
+
+type tunnelBinding struct {
+	g *sessionGroup
+	t *tunnel
+}
+
+func newClientRun(client *rdv.Client, method string, smuxConfig *smux.Config, groups []*sessionGroup) *clientRun {
+	return &clientRun{
+		client:     client,
+		method:     method,
+		smuxConfig: smuxConfig,
+		groups:     groups,
+		listeners:  make(map[string][]*tunnelListener),
+		started:    time.Now(),
+		stopped:    make(chan error, 1),
+	}
+}
+
+// Returns the tunnels of -tunnels, or else of -l or -r, with their acls.
+func clientTunnels(accept bool) ([]*tunnel, error) {
+	var tunnels []*tunnel
+	if flagTunnels != "" {
+		var err error
+		if tunnels, err = loadTunnels(flagTunnels); err != nil {
+			return nil, err
+		}
+		if err := checkEndpoints(tunnels, accept); err != nil {
+			return nil, err
+		}
+	} else if accept {
+		tunnels = legacyTunnels(localAddr, true)
+	} else {
+		tunnels = legacyTunnels(remoteAddr, false)
+	}
+	for _, t := range tunnels {
+		if err := t.parseACL(splitList(flagAllow), splitList(flagDeny)); err != nil {
+			return nil, fmt.Errorf("tunnel [%s]: %w", t.Name, err)
+		}
+	}
+	return tunnels, nil
+}
+
+// Starts the local listeners, on the accept side, and then the sessions.
+func (r *clientRun) start() error {
+	if isServer {
+		// 全局读取来自nat源的包
+		for _, g := range r.groups {
+			for _, t := range g.tunnelList() {
+				if err := r.listen(g, t, nil); err != nil {
+					for name := range r.listeners {
+						r.closeListeners(name)
+					}
+					return fmt.Errorf("tunnel [%s]: %w", t.Name, err)
+				}
+			}
+		}
+	}
+	for _, g := range r.groups {
+		r.startGroup(g)
+	}
+	return nil
+}
+
+// Connects the pooled conns of the group, until it is drained.
+func (r *clientRun) startGroup(g *sessionGroup) {
+	ctx, cancel := context.WithCancel(context.Background())
+	g.stop = cancel
+	n := len(g.tunnelList())
+	for i := range g.members {
+		r.wg.Add(1)
+		r.live.Add(1)
+		go func() {
+			defer r.wg.Done()
+			slog.Info("client: session started", "session", g.name, "tunnels", n, "model", r.method, "token", g.memberToken(i))
+			err := clientCmd(ctx, r.client, g, i, r.method, r.smuxConfig)
+			if err != nil {
+				slog.Error("client: session stopped", "session", g.name, "token", g.memberToken(i), "err", err)
+			}
+			if r.live.Add(-1) == 0 && err != nil {
+				select {
+				case r.stopped <- err:
+				default:
+				}
+			}
+		}()
+	}
+}
+
+// Listens on the tunnel's addrs. The listeners of the previous config of the tunnel, if any, are
+// kept for the addrs which remain, unless the socket mode has changed, and the others are closed.
+func (r *clientRun) listen(g *sessionGroup, t *tunnel, prev *tunnel) error {
+	var kept []*tunnelListener
+	for _, l := range r.listeners[t.Name] {
+		if prev != nil && prev.Mode == t.Mode && slices.Contains(t.Listen, l.addr) {
+			l.binding.Store(&tunnelBinding{g, t})
+			kept = append(kept, l)
+		} else {
+			l.Close()
+		}
+	}
+	r.listeners[t.Name] = kept
+	for _, addr := range t.Listen {
+		if slices.ContainsFunc(kept, func(l *tunnelListener) bool { return l.addr == addr }) {
+			continue
+		}
+		ln, err := listenEndpoint(t, addr)
+		if err != nil {
+			return err
+		}
+		l := &tunnelListener{Listener: ln, addr: addr}
+		l.binding.Store(&tunnelBinding{g, t})
+		r.listeners[t.Name] = append(r.listeners[t.Name], l)
+		log.Println("listening on:", ln.Addr(), "tunnel", t.Name)
+		go acceptTunnel(l)
+	}
+	return nil
+}
+
+func (r *clientRun) closeListeners(name string) {
+	for _, l := range r.listeners[name] {
+		l.Close()
+	}
+	delete(r.listeners, name)
+}
+
+// Applies a new tunnel config. The sessions of remaining groups are kept, along with their
+// streams, as are the listeners of remaining addrs. Removed tunnels stop listening, whereas their
+// streams may finish, and removed groups are drained in the background.
+func (r *clientRun) reload(tunnels []*tunnel, timeout time.Duration) {
+	prev := make(map[string]*tunnel)
+	for _, g := range r.groups {
+		for _, t := range g.tunnelList() {
+			prev[t.Name] = t
+		}
+	}
+	groups := groupTunnels(tunnels, token, flagPool, !isServer && flagServeStdio)
+	var started, dropped []string
+	var startGroups, dropGroups []*sessionGroup
+	for i, g := range groups {
+		j := slices.IndexFunc(r.groups, func(o *sessionGroup) bool { return o.name == g.name })
+		if j < 0 {
+			started = append(started, g.name)
+			startGroups = append(startGroups, g)
+			continue
+		}
+		r.groups[j].setTunnels(g.tunnelList())
+		groups[i] = r.groups[j]
+	}
+	for _, g := range r.groups {
+		if !slices.Contains(groups, g) {
+			dropped = append(dropped, g.name)
+			dropGroups = append(dropGroups, g)
+		}
+	}
+
+	var added, removed, changed []string
+	for name := range prev {
+		if !slices.ContainsFunc(tunnels, func(t *tunnel) bool { return t.Name == name }) {
+			// Before listening, since a renamed tunnel may keep the addr
+			removed = append(removed, name)
+			r.closeListeners(name)
+		}
+	}
+	slices.Sort(removed)
+	for _, g := range groups {
+		for _, t := range g.tunnelList() {
+			p := prev[t.Name]
+			if p == nil {
+				added = append(added, t.Name)
+			} else if !reflect.DeepEqual(p, t) {
+				changed = append(changed, t.Name)
+			}
+			if !isServer {
+				continue
+			}
+			if err := r.listen(g, t, p); err != nil {
+				slog.Error("client: listen failed", "tunnel", t.Name, "err", err)
+			}
+		}
+	}
+
+	r.mu.Lock()
+	r.groups = groups
+	r.mu.Unlock()
+	for _, g := range startGroups {
+		r.startGroup(g)
+	}
+	if len(dropGroups) > 0 {
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			drainGroups(dropGroups, timeout)
+		}()
+	}
+	slog.Info("client: tunnels reloaded", "added", added, "removed", removed, "changed", changed,
+		"sessions_started", started, "sessions_drained", dropped)
+}
+
+func (r *clientRun) groupList() []*sessionGroup {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.groups
+}
+
+// Stops accepting local conns, drains all groups, and waits for them to finish.
+func (r *clientRun) drain(timeout time.Duration) {
+	for name := range r.listeners {
+		r.closeListeners(name)
+	}
+	drainGroups(r.groups, timeout)
+	r.wg.Wait()
+}
+
+// Stops the groups from reconnecting, tells the peers to stop opening streams, waits for the
+// streams to finish up to the timeout, and then closes the sessions.
+func drainGroups(groups []*sessionGroup, timeout time.Duration) {
+	var sessions []*smux.Session
+	for _, g := range groups {
+		// Sessions connected after this close themselves, see clientCmd
+		g.stop()
+		for i := range g.members {
+			if sess := g.members[i].Load(); sess != nil {
+				sess.GoAway()
+				sessions = append(sessions, sess)
+			}
+		}
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		n := 0
+		for _, sess := range sessions {
+			n += sess.NumStreams()
+		}
+		if n == 0 {
+			break
+		} else if time.Now().After(deadline) {
+			slog.Warn("client: drain timed out, closing streams", "streams", n)
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	for _, sess := range sessions {
+		sess.Close()
+	}
+}
+
+// Runs until SIGINT or SIGTERM, and then drains. The tunnels are reloaded upon SIGHUP, or when
+// the -tunnels file has been modified, unless the new config is invalid. A second SIGINT or
+// SIGTERM exits without waiting for the drain. SIGHUP also reopens the access log, for log
+// rotation. Returns an error if all sessions have given up.
+func serveClient(r *clientRun) error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	ticker := time.NewTicker(tunnelsPollInterval)
+	defer ticker.Stop()
+	modTime := fileModTime(flagTunnels)
+	for {
+		select {
+		case sig := <-sigs:
+			if sig != syscall.SIGHUP {
+				signal.Reset(os.Interrupt, syscall.SIGTERM)
+				slog.Info("client: draining", "signal", sig, "timeout", flagDrain)
+				r.drain(flagDrain)
+				return nil
+			}
+			if err := streamLog.reopen(); err != nil {
+				slog.Error("client: reopening the access log failed", "err", err)
+			}
+		case <-ticker.C:
+			if flagTunnels == "" || fileModTime(flagTunnels).Equal(modTime) {
+				continue
+			}
+		case err := <-r.stopped:
+			r.drain(0)
+			return fmt.Errorf("all sessions stopped: %w", err)
+		}
+		modTime = fileModTime(flagTunnels)
+		tunnels, err := clientTunnels(isServer)
+		if err != nil {
+			slog.Error("client: reload failed, keeping the tunnels", "err", err)
+			continue
+		}
+		r.reload(tunnels, flagDrain)
+	}
+}
+
+// Returns the modification time of the file, or zero if it can't be read.
+func fileModTime(name string) time.Time {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
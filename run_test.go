@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/betamos/rdv"
+	"github.com/xtaci/smux"
+)
+
+// Sets up the globals of an accept side run whose rdv server refuses conns, so that the sessions
+// keep retrying until drained.
+func setTestRun(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	prevServer, prevAddrs, prevToken, prevPool := isServer, relayAddrs, token, flagPool
+	isServer, relayAddrs, token, flagPool = true, []string{"http://" + ln.Addr().String()}, "test", 1
+	t.Cleanup(func() {
+		isServer, relayAddrs, token, flagPool = prevServer, prevAddrs, prevToken, prevPool
+	})
+}
+
+func listenerOf(r *clientRun, name string) *tunnelListener {
+	if ls := r.listeners[name]; len(ls) == 1 {
+		return ls[0]
+	}
+	return nil
+}
+
+func TestReload(t *testing.T) {
+	setTestRun(t)
+	tunnels := []*tunnel{
+		{Name: "kept", Session: "shared", Listen: listenAddrs{"127.0.0.1:0"}},
+		{Name: "changed", Session: "shared", Listen: listenAddrs{"127.0.0.2:0"}},
+		{Name: "removed", Listen: listenAddrs{"127.0.0.3:0"}},
+	}
+	r := newClientRun(&rdv.Client{}, rdv.ACCEPT, smux.DefaultConfig(), groupTunnels(tunnels, token, flagPool, false))
+	if err := r.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.drain(0)
+	shared, removedGroup := r.groups[0], r.groups[1]
+	kept, changed, removed := listenerOf(r, "kept"), listenerOf(r, "changed"), listenerOf(r, "removed")
+
+	// A session of the removed group, which must be drained
+	c1, c2 := net.Pipe()
+	sess, _ := smux.Client(c1, nil)
+	peer, _ := smux.Server(c2, nil)
+	defer peer.Close()
+	removedGroup.members[0].Store(sess)
+
+	r.reload([]*tunnel{
+		{Name: "kept", Session: "shared", Listen: listenAddrs{"127.0.0.1:0"}},
+		{Name: "changed", Session: "shared", Listen: listenAddrs{"127.0.0.2:0"}, Idle: "1m"},
+		{Name: "added", Listen: listenAddrs{"127.0.0.4:0"}},
+	}, 0)
+
+	if len(r.groups) != 2 || r.groups[0] != shared || r.groups[1].name != "added" {
+		t.Fatalf("expected the shared group to be kept and the added one to be started, got %v", r.groups)
+	}
+	if g, tun := findTunnel(r.groups, "changed"); g != shared || tun.Idle != "1m" {
+		t.Errorf("expected the changed tunnel in the shared group, got %v", tun)
+	}
+	if _, tun := findTunnel(r.groups, "removed"); tun != nil {
+		t.Errorf("expected the removed tunnel to be gone")
+	}
+
+	if l := listenerOf(r, "kept"); l != kept || l.binding.Load().g != shared {
+		t.Errorf("expected the listener of the kept tunnel to be kept")
+	}
+	if l := listenerOf(r, "changed"); l != changed || l.binding.Load().t.Idle != "1m" {
+		t.Errorf("expected the listener of the changed tunnel to be kept, with the new config")
+	}
+	if listenerOf(r, "removed") != nil {
+		t.Errorf("expected no listener of the removed tunnel")
+	}
+	if _, err := removed.Accept(); err == nil {
+		t.Errorf("expected the listener of the removed tunnel to be closed")
+	}
+	if l := listenerOf(r, "added"); l == nil || l.binding.Load().g != r.groups[1] {
+		t.Errorf("expected a listener of the added tunnel")
+	}
+
+	select {
+	case <-peer.GoingAway():
+	case <-time.After(time.Second):
+		t.Fatal("expected the removed group to be drained")
+	}
+	deadline := time.Now().Add(time.Second)
+	for !sess.IsClosed() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !sess.IsClosed() {
+		t.Errorf("expected the session of the removed group to be closed")
+	}
+}
+
+// Drained sessions are closed once their streams have finished, or at the timeout.
+func TestDrainGroups(t *testing.T) {
+	for _, finish := range []bool{true, false} {
+		g := groupTunnels([]*tunnel{{Name: "drained"}}, "test", 1, false)[0]
+		stopped := false
+		g.stop = func() { stopped = true }
+		c1, c2 := net.Pipe()
+		sess, _ := smux.Client(c1, nil)
+		peer, _ := smux.Server(c2, nil)
+		defer peer.Close()
+		g.members[0].Store(sess)
+		stream, err := sess.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted, err := peer.AcceptStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		timeout := 500 * time.Millisecond
+		done := make(chan time.Duration)
+		start := time.Now()
+		go func() {
+			drainGroups([]*sessionGroup{g}, timeout)
+			done <- time.Since(start)
+		}()
+		<-peer.GoingAway()
+		if _, err := peer.OpenStream(); err != smux.ErrGoAway {
+			t.Errorf("expected the peer to stop opening streams, got %v", err)
+		}
+		if finish {
+			stream.Close()
+			accepted.Close()
+		}
+		took := <-done
+		if !stopped {
+			t.Errorf("expected the group to stop reconnecting")
+		}
+		if !sess.IsClosed() {
+			t.Errorf("expected the session to be closed")
+		}
+		if finish && took >= timeout {
+			t.Errorf("expected the drain to end with the stream, took %v", took)
+		} else if !finish && took < timeout {
+			t.Errorf("expected the drain to wait for the timeout, took %v", took)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/betamos/rdv"
+	"github.com/xtaci/smux"
+)
+
+// stdioConn is stdin and stdout as a conn, with half-close.
+type stdioConn struct{}
+
+func (stdioConn) Read(p []byte) (int, error)  { return os.Stdin.Read(p) }
+func (stdioConn) Write(p []byte) (int, error) { return os.Stdout.Write(p) }
+func (stdioConn) CloseWrite() error           { return os.Stdout.Close() }
+
+func (stdioConn) Close() error {
+	os.Stdin.Close()
+	return os.Stdout.Close()
+}
+
+// Forwards stdin and stdout over a single stream of the tunnel, e.g. as an ssh ProxyCommand, and
+// returns when both directions are done. The dial side of the tunnel waits with rdv DIAL, so this
+// takes the accept role, with a single conn instead of a listener. It uses the stdio token, which
+// the dial side serves with a single extra member if it runs with -serve-stdio, so runs are served
+// one at a time: another run waits in the rdv lobby until the current one ends, or fails once the
+// lobby times out.
+func stdioCmd(client *rdv.Client, g *sessionGroup, t *tunnel, smuxConfig *smux.Config) error {
+	conn, _, err := client.DoAny(context.Background(), rdv.ACCEPT, relayAddrs, g.stdioToken(), nil)
+	if err != nil {
+		return err
+	}
+	slog.Info("client: peer connected", "is_relay", conn.IsRelay, "addr", conn.RemoteAddr())
+	sess, err := smux.Server(conn, smuxConfig)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer sess.Close()
+	meta := streamMeta{Service: t.Name, Source: "stdio", Compress: t.compression()}
+	stream, err := openStream(sess, meta)
+	if err != nil {
+		return err
+	}
+	rwc, _ := compressOpened(stream, meta)
+	done := make(chan error, 2)
+	go func() {
+		_, _, err := forward(stdioConn{}, rwc, t.idleTimeout(), t.lifetimeEnd(time.Now()))
+		// Tells the dial side that the run is done, see stdioDone
+		sess.GoAway()
+		done <- err
+	}()
+	go func() {
+		// The peer doesn't open streams, so this returns once the session has failed, whereas
+		// a blocked read of stdin may not return until ssh exits
+		_, err := sess.AcceptStream()
+		done <- err
+	}()
+	return <-done
+}
+
+// Reports whether the session of the stdio member ended since the stdio run was done, rather than
+// failed, so that the member reconnects right away for the next run.
+func stdioDone(g *sessionGroup, member int, sess *smux.Session) bool {
+	if !g.isStdio(member) {
+		return false
+	}
+	select {
+	case <-sess.GoingAway():
+		return true
+	default:
+		return false
+	}
+}
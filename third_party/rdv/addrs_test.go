@@ -0,0 +1,151 @@
+package rdv
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestAddrSpaceFrom(t *testing.T) {
+	tests := map[string]struct {
+		addr  string
+		space AddrSpace
+	}{
+		"loopback4":  {addr: "127.0.0.2", space: SpaceLoopback4},
+		"loopback6":  {addr: "::1", space: SpaceLoopback6},
+		"private4":   {addr: "192.168.0.2", space: SpacePrivate4},
+		"private6":   {addr: "fd00::1", space: SpacePrivate6},
+		"private6-2": {addr: "fd12:3456:789a:1::1", space: SpacePrivate6},
+		"link6":      {addr: "fe80::1234", space: SpaceLink6},
+		"link6_zone": {addr: "fe80::1234%%en0", space: SpaceLink6},
+		"link4":      {addr: "169.254.12.1", space: SpaceLink4},
+		"public4":    {addr: "213.213.213.213", space: SpacePublic4},
+		"public6":    {addr: "2003::1", space: SpacePublic6},
+		"tailscale":  {addr: "100.86.144.76", space: SpacePublic4},
+		"zero4":      {addr: "0.0.0.0", space: SpaceInvalid},
+		"zero6":      {addr: "::", space: SpaceInvalid},
+		"broadcast":  {addr: "255.255.255.255", space: SpaceInvalid},
+		"multicast4": {addr: "224.0.0.251", space: SpaceInvalid},
+		"multicast6": {addr: "ff02::fb", space: SpaceInvalid},
+		"v4mapped":   {addr: "::ffff:192.0.2.128", space: SpacePublic6},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			addr, err := netip.ParseAddr(tc.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			space := AddrSpaceFrom(addr)
+			if space != tc.space {
+				t.Fatalf("expected %v, got %v", tc.space, space)
+			}
+		})
+	}
+}
+
+func TestAddrSpaceIncluded(t *testing.T) {
+	var spaces AddrSpace = SpacePrivate4 | SpacePublic6
+	if !spaces.Includes(SpacePrivate4) {
+		t.Errorf("expected private4 included")
+	}
+	if !spaces.Includes(SpacePublic6) {
+		t.Errorf("expected public6 included")
+	}
+	if spaces.Includes(SpaceLoopback4) {
+		t.Errorf("expected loopback to not be included")
+	}
+	if spaces.Includes(SpaceLoopback6) {
+		t.Errorf("expected loopback to not be included")
+	}
+	if spaces.Includes(SpaceInvalid) {
+		t.Errorf("expected invalid to not be included")
+	}
+
+	if !AllSpaces.Includes(SpacePrivate4) {
+		t.Errorf("all: expected private4 be included")
+	}
+	if AllSpaces.Includes(SpaceInvalid) {
+		t.Errorf("all: expected invalid to not be included")
+	}
+	if NoSpaces.Includes(SpacePrivate4) {
+		t.Errorf("no: expected private4 to not be included")
+	}
+	if NoSpaces.Includes(SpaceInvalid) {
+		t.Errorf("no: expected invalid to not be included")
+	}
+}
+
+// Sanity check that we've assigned the test addrs to the correct spaces
+func TestProbeAddrSpaces(t *testing.T) {
+	for space, addr := range udpProbeAddrs {
+		s := AddrSpaceFrom(addr)
+		if s != space {
+			t.Errorf("addr %v: expected space %v, got %v", addr, space, s)
+		}
+	}
+}
+
+func TestSelfAddrs(t *testing.T) {
+
+	// This would be typical for ipv4 behind NAT with ipv6 support
+	addrMap := map[AddrSpace]netip.Addr{
+		SpacePrivate4: netip.MustParseAddr("192.168.1.7"),
+		SpacePublic4:  netip.MustParseAddr("192.168.1.7"),
+		SpacePrivate6: netip.MustParseAddr("fd00::7"), // Add a ULA too
+		SpaceLink6:    netip.MustParseAddr("fe80::7%%en0"),
+		SpacePublic6:  netip.MustParseAddr("2400::7"),
+	}
+
+	// Just the public addrs
+	got := selfAddrs(addrMap, 1234, PublicSpaces)
+	expect := []netip.AddrPort{netip.MustParseAddrPort("[2400::7]:1234")}
+	if !slices.Equal(got, expect) {
+		t.Errorf("public: expected %v, got %v", expect, got)
+	}
+
+	// Include the private addrs, which should be deduplicated and sorted
+	got = selfAddrs(addrMap, 1234, AllSpaces)
+	expect = []netip.AddrPort{
+		netip.MustParseAddrPort("192.168.1.7:1234"),
+		netip.MustParseAddrPort("[2400::7]:1234"),
+		netip.MustParseAddrPort("[fd00::7]:1234"),
+		netip.MustParseAddrPort("[fe80::7]:1234"), // zone stripped
+	}
+	if !slices.Equal(got, expect) {
+		t.Errorf("private: expected %v, got %v", expect, got)
+	}
+}
+
+func TestProbeLocalAddrsLoopback(t *testing.T) {
+
+	// This will be different on every system
+	addrMap := probeLocalAddrs(AllSpaces)
+
+	// But we should always have good old localhost
+	got := addrMap[SpaceLoopback4]
+	expect := netip.MustParseAddr("127.0.0.1")
+
+	if got != expect {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
+
+func TestAddrPortFrom(t *testing.T) {
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:1234")
+	got := AddrPortFrom(addr)
+	expect := netip.MustParseAddrPort("127.0.0.1:1234")
+	if got != expect {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
+
+func TestAddrPortFromNil(t *testing.T) {
+	var addr net.Addr
+	got := AddrPortFrom(addr)
+	expect := netip.AddrPort{}
+	if got != expect {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
@@ -0,0 +1,144 @@
+package rdv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/nettest"
+)
+
+func ExampleClient() {
+	client := &Client{}
+	conn, _, err := client.Dial(context.Background(), "http://example.com/", "abc", nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	// Conn is either a direct p2p, or relayed, TCP-based conn with the other peer
+}
+
+func testClients(t *testing.T, spaces AddrSpace) *Conn {
+	client := &Client{
+		AddrSpaces: spaces,
+		Timeout:    time.Second,
+		Picker:     WaitForP2P(100 * time.Millisecond),
+	}
+	server := &Server{}
+	server.Start()
+	laddr := "127.0.0.2:48374" // listen on alt local addr to differentiate relay-p2p
+	addr := fmt.Sprintf("http://%v/", laddr)
+	ln, _ := net.Listen("tcp", laddr)
+	defer ln.Close()
+	go http.Serve(ln, server)
+
+	data := []byte("hello")
+	go func() {
+		ac, _, err := client.Accept(context.Background(), addr, "abc", nil)
+		if err != nil {
+			t.Errorf("accept failed: %v", err)
+			return
+		}
+		ac.Write(data)
+		ac.Close()
+	}()
+	dc, _, err := client.Dial(context.Background(), addr, "abc", nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	got, err := io.ReadAll(dc)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	if !slices.Equal(got, data) {
+		t.Fatalf("expected %v, got %v", data, got)
+	}
+	return dc
+}
+
+// Establish a p2p conn over localhost
+func TestClientsLoopback(t *testing.T) {
+	dc := testClients(t, SpaceLoopback4)
+	if dc.IsRelay {
+		t.Errorf("expected p2p, is relay")
+	}
+	expect := netip.MustParseAddr("127.0.0.1")
+	got := AddrPortFrom(dc.RemoteAddr()).Addr()
+	if got != expect {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
+
+// Establish a relay conn by disabling all p2p options
+func TestClientsRelay(t *testing.T) {
+	dc := testClients(t, NoSpaces)
+	if !dc.IsRelay {
+		t.Errorf("expected relay, is p2p")
+	}
+	expect := netip.MustParseAddr("127.0.0.2")
+	got := AddrPortFrom(dc.RemoteAddr()).Addr()
+	if got != expect {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
+
+// Wrap conn to make Read thread-safe, because that's what nettest expects
+// https://github.com/golang/go/issues/27203
+type muconn struct {
+	net.Conn
+
+	rmu sync.Mutex
+}
+
+func (c *muconn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	return c.Conn.Read(p)
+}
+
+// Test that a relay conn conforms with nettest.
+// This could possibly find issues with bytes not being forwarded in time, especially when conns
+// are half-open/closed near the end.
+func TestRelayNettest(t *testing.T) {
+	client := &Client{
+		AddrSpaces: NoSpaces,
+		Timeout:    time.Second,
+		Picker:     PickFirst(),
+	}
+	server := &Server{}
+	server.Start()
+	laddr := "127.0.0.2:48375" // listen on alt local addr to differentiate relay-p2p
+	addr := fmt.Sprintf("http://%v/", laddr)
+	ln, _ := net.Listen("tcp", laddr)
+	defer ln.Close()
+	go http.Serve(ln, server)
+	idx := new(atomic.Int64)
+
+	nettest.TestConn(t, func() (c1 net.Conn, c2 net.Conn, stop func(), err error) {
+		token := fmt.Sprintf("nettest-%v", idx.Add(1))
+		var aerr error
+		done := make(chan struct{})
+		go func() {
+			c2, _, aerr = client.Accept(context.Background(), addr, token, nil)
+			close(done)
+		}()
+		c1, _, derr := client.Dial(context.Background(), addr, token, nil)
+		<-done
+		stop = func() {
+			c1.Close()
+			c2.Close()
+		}
+		c1, c2 = &muconn{Conn: c1}, &muconn{Conn: c2}
+		err = errors.Join(aerr, derr)
+		return
+	})
+}
@@ -0,0 +1,210 @@
+package rdv
+
+import (
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// Shared secret of the cluster, which authenticates forwarded conns. Request only.
+	hClusterSecret = "Rdv-Cluster-Secret"
+
+	// Observed addr of a client whose conn was forwarded by another node. Request only.
+	hForwardedFor = "Rdv-Forwarded-For"
+
+	// Max time to connect to another node.
+	clusterDialTimeout = 5 * time.Second
+)
+
+// ClusterLobby shares the lobby between rdv servers, e.g. behind a load balancer. Each token is
+// owned by a single node, chosen by rendezvous hashing. Conns that arrive at another node are
+// forwarded to the owner over an inter-node link, and the receiving node relays between the client
+// and the owner, which matches and serves the pair.
+//
+// If the owner can't be reached, the next node in hash order is tried, so that both peers agree
+// on the same fallback. All nodes must use the same Nodes and Secret.
+type ClusterLobby struct {
+	// Url of this node's rdv endpoint, as it appears in Nodes.
+	Self string
+
+	// Urls of the rdv endpoints of all nodes, including Self.
+	Nodes []string
+
+	// Shared secret which authenticates nodes to each other. Must not be empty.
+	Secret string
+
+	// Lobby for tokens owned by this node. If nil, a [MemoryLobby] with the LobbyTimeout is used.
+	Local Lobby
+
+	// Amount of time that one peer can wait in the default local lobby for its partner. Zero means
+	// no timeout. See [Server.LobbyTimeout], which doesn't apply to a custom lobby.
+	LobbyTimeout time.Duration
+
+	// Relays between conns and the nodes they were forwarded to. Its idle timeout also applies
+	// while a conn waits in the lobby of the other node. If nil, a zero-value [Relayer] is used.
+	Relayer *Relayer
+
+	// Custom TLS config for https nodes, e.g. with a client certificate.
+	TlsConfig *tls.Config
+
+	// Allows http nodes, which receive the secret in plaintext. Only for trusted networks.
+	AllowHTTP bool
+
+	// Optional logger to use.
+	Logger *slog.Logger
+
+	log    *slog.Logger
+	local  Lobby
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup // Forwarded conns
+	once   sync.Once
+
+	mu     sync.Mutex // Guards closed, since forwarded conns may fall back to the local lobby
+	closed bool
+}
+
+func (l *ClusterLobby) init() {
+	l.once.Do(func() {
+		l.log = cmp.Or(l.Logger, nopLogger)
+		l.local = cmp.Or[Lobby](l.Local, &MemoryLobby{Timeout: l.LobbyTimeout, Logger: l.Logger})
+		l.ctx, l.cancel = context.WithCancel(context.Background())
+	})
+}
+
+func (l *ClusterLobby) Serve(match func(dc, ac *Conn)) {
+	l.init()
+	l.local.Serve(match)
+	l.wg.Wait()
+}
+
+func (l *ClusterLobby) Shutdown() {
+	l.init()
+	l.cancel()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	l.local.Shutdown()
+}
+
+// Joins the local lobby if the conn was forwarded, or if this node owns the token.
+// Otherwise the conn is forwarded to its owner.
+func (l *ClusterLobby) Join(conn *Conn) {
+	l.init()
+	req := conn.Request
+	if secret := req.Header.Get(hClusterSecret); secret != "" {
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(l.Secret)) != 1 || l.Secret == "" {
+			l.log.Warn("rdv: bad cluster secret", "addr", req.RemoteAddr)
+			writeResponseErr(conn, http.StatusForbidden, "bad cluster secret")
+			return
+		}
+		observedAddr, err := netip.ParseAddrPort(req.Header.Get(hForwardedFor))
+		if err == nil {
+			conn.ObservedAddr = &observedAddr
+		} else {
+			conn.ObservedAddr = nil
+		}
+		l.local.Join(conn)
+		return
+	}
+	if l.nodes(conn.Token)[0] == l.Self {
+		l.local.Join(conn)
+		return
+	}
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		l.forward(conn)
+	}()
+}
+
+// Returns the nodes in order of preference for the token (highest random weight first).
+func (l *ClusterLobby) nodes(token string) []string {
+	return rankByHash(l.Nodes, token)
+}
+
+// Forwards the conn to the first reachable node in hash order, and relays between the two until
+// either side is done. If this node comes first, the conn joins the local lobby instead.
+func (l *ClusterLobby) forward(conn *Conn) {
+	log := l.log.With("token", conn.Token)
+	for _, node := range l.nodes(conn.Token) {
+		if node == l.Self {
+			l.joinLocal(conn)
+			return
+		}
+		link, err := l.dialNode(node, conn)
+		if err != nil {
+			log.Warn("rdv: cluster node unreachable", "node", node, "err", err)
+			continue
+		}
+		log.Debug("rdv: forwarded", "node", node, "addr", conn.ObservedAddr)
+		cmp.Or(l.Relayer, new(Relayer)).Relay(l.ctx, link, conn, conn, link)
+		return
+	}
+	writeResponseErr(conn, http.StatusServiceUnavailable, "no rdv cluster node reachable, try again")
+}
+
+// Joins the local lobby from a forwarding goroutine, unless the lobby has been shut down.
+func (l *ClusterLobby) joinLocal(conn *Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		writeResponseErr(conn, http.StatusServiceUnavailable, "rdv server shutting down, try again")
+		return
+	}
+	l.local.Join(conn)
+}
+
+// Connects to a node and writes the client's request, with the cluster headers. The response is
+// written by the node, and relayed back to the client.
+func (l *ClusterLobby) dialNode(node string, conn *Conn) (net.Conn, error) {
+	urlStr, err := url.JoinPath(node, conn.Token)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" && !l.AllowHTTP {
+		return nil, fmt.Errorf("refusing to send the cluster secret to %s over %s", u.Host, u.Scheme)
+	}
+	ctx, cancel := context.WithTimeout(l.ctx, clusterDialTimeout)
+	defer cancel()
+	netd := &net.Dialer{}
+	var nc net.Conn
+	hostPort := net.JoinHostPort(u.Hostname(), urlPort(u))
+	if u.Scheme == "https" {
+		tlsd := &tls.Dialer{NetDialer: netd, Config: l.TlsConfig}
+		nc, err = tlsd.DialContext(ctx, "tcp", hostPort)
+	} else {
+		nc, err = netd.DialContext(ctx, "tcp", hostPort)
+	}
+	if err != nil {
+		return nil, err
+	}
+	req := conn.Request.Clone(ctx)
+	req.URL, req.Host, req.RequestURI = u, u.Host, ""
+	req.Header.Set(hClusterSecret, l.Secret)
+	req.Header.Del(hForwardedFor)
+	if conn.ObservedAddr != nil {
+		req.Header.Set(hForwardedFor, conn.ObservedAddr.String())
+	}
+	nc.SetWriteDeadline(time.Now().Add(clusterDialTimeout))
+	if err := req.Write(nc); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	nc.SetWriteDeadline(time.Time{})
+	return nc, nil
+}
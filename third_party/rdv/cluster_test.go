@@ -0,0 +1,191 @@
+package rdv
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testClusterSecret = "s3cret"
+
+type testNode struct {
+	url    string
+	ln     net.Listener
+	server *Server
+}
+
+// Stops the node, as if it was down.
+func (n *testNode) stop() {
+	n.ln.Close()
+	n.server.Close()
+}
+
+// Starts n cluster nodes on loopback, with the lobby customized by config, if not nil.
+func testCluster(t *testing.T, n int, config func(*ClusterLobby)) []*testNode {
+	var nodes []*testNode
+	var urls []string
+	for range n {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		node := &testNode{url: "http://" + ln.Addr().String() + "/", ln: ln}
+		nodes = append(nodes, node)
+		urls = append(urls, node.url)
+	}
+	for _, node := range nodes {
+		lobby := &ClusterLobby{
+			Self:      node.url,
+			Nodes:     urls,
+			Secret:    testClusterSecret,
+			AllowHTTP: true,
+		}
+		if config != nil {
+			config(lobby)
+		}
+		node.server = &Server{Lobby: lobby}
+		node.server.Start()
+		go http.Serve(node.ln, node.server)
+		t.Cleanup(node.stop)
+	}
+	return nodes
+}
+
+// Returns the nodes in hash order for the token, the owner first.
+func rankNodes(nodes []*testNode, token string) []*testNode {
+	var urls []string
+	for _, node := range nodes {
+		urls = append(urls, node.url)
+	}
+	var ranked []*testNode
+	for _, url := range rankByHash(urls, token) {
+		i := slices.IndexFunc(nodes, func(n *testNode) bool { return n.url == url })
+		ranked = append(ranked, nodes[i])
+	}
+	return ranked
+}
+
+// Connects a pair of peers through the given nodes, and checks that data gets across.
+func testClusterPair(t *testing.T, dialNode, acceptNode *testNode, token string) {
+	client := &Client{AddrSpaces: NoSpaces, Timeout: 2 * time.Second}
+	data := []byte("hello across nodes")
+	go func() {
+		ac, _, err := client.Accept(context.Background(), acceptNode.url, token, nil)
+		if err != nil {
+			t.Errorf("accept failed: %v", err)
+			return
+		}
+		ac.Write(data)
+		ac.Close()
+	}()
+	dc, _, err := client.Dial(context.Background(), dialNode.url, token, nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer dc.Close()
+	got, err := io.ReadAll(dc)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if !slices.Equal(got, data) {
+		t.Fatalf("expected %q, got %q", data, got)
+	}
+}
+
+// Peers which join different nodes, neither of which owns the token, are matched by the owner.
+func TestClusterForward(t *testing.T) {
+	nodes := testCluster(t, 3, nil)
+	ranked := rankNodes(nodes, "forward")
+	testClusterPair(t, ranked[1], ranked[2], "forward")
+}
+
+// Peers which join the owner and another node are matched.
+func TestClusterForwardToOwner(t *testing.T) {
+	nodes := testCluster(t, 2, nil)
+	ranked := rankNodes(nodes, "owner")
+	testClusterPair(t, ranked[1], ranked[0], "owner")
+}
+
+// If the owner is down, both peers fall back to the next node in hash order.
+func TestClusterOwnerDown(t *testing.T) {
+	nodes := testCluster(t, 3, nil)
+	ranked := rankNodes(nodes, "down")
+	ranked[0].stop()
+	testClusterPair(t, ranked[2], ranked[1], "down")
+}
+
+// A conn claiming to be forwarded, with the wrong secret, is rejected.
+func TestClusterBadSecret(t *testing.T) {
+	nodes := testCluster(t, 2, nil)
+	client := &Client{AddrSpaces: NoSpaces, Timeout: 2 * time.Second}
+	header := http.Header{hClusterSecret: {"wrong"}}
+	_, resp, err := client.Dial(context.Background(), nodes[0].url, "secret", header)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403, got %v", resp)
+	}
+}
+
+// The lobby timeout applies to conns forwarded from other nodes.
+func TestClusterLobbyTimeout(t *testing.T) {
+	nodes := testCluster(t, 2, func(l *ClusterLobby) {
+		l.LobbyTimeout = 200 * time.Millisecond
+	})
+	ranked := rankNodes(nodes, "timeout")
+	client := &Client{AddrSpaces: NoSpaces, Timeout: 5 * time.Second}
+	t0 := time.Now()
+	_, resp, err := client.Dial(context.Background(), ranked[1].url, "timeout", nil)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if resp == nil || resp.StatusCode != http.StatusRequestTimeout {
+		t.Fatalf("expected 408, got %v", resp)
+	}
+	if dur := time.Since(t0); dur > 2*time.Second {
+		t.Errorf("expected the lobby timeout, got a response after %v", dur)
+	}
+}
+
+// Forwarded conns are relayed by the Relayer, whose idle timeout closes them.
+func TestClusterRelayer(t *testing.T) {
+	nodes := testCluster(t, 2, func(l *ClusterLobby) {
+		l.Relayer = &Relayer{IdleTimeout: 300 * time.Millisecond}
+	})
+	ranked := rankNodes(nodes, "idle")
+	client := &Client{AddrSpaces: NoSpaces, Timeout: 2 * time.Second, Picker: PickFirst()}
+	accepted := make(chan *Conn, 1)
+	go func() {
+		ac, _, _ := client.Accept(context.Background(), ranked[0].url, "idle", nil)
+		accepted <- ac
+	}()
+	dc, _, err := client.Dial(context.Background(), ranked[1].url, "idle", nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer dc.Close()
+	if ac := <-accepted; ac != nil {
+		defer ac.Close()
+	}
+	dc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := dc.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected EOF from the idle timeout, got %v", err)
+	}
+}
+
+// The secret isn't sent to http nodes unless allowed.
+func TestClusterRefusesHTTP(t *testing.T) {
+	lobby := &ClusterLobby{Secret: testClusterSecret}
+	lobby.init()
+	defer lobby.Shutdown()
+	conn := &Conn{Meta: &Meta{Token: "http"}}
+	if _, err := lobby.dialNode("http://127.0.0.1:1/", conn); err == nil || !strings.Contains(err.Error(), "refusing") {
+		t.Fatalf("expected a refusal, got %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+package rdv
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/netip"
+	"testing"
+)
+
+// Read the header and verify that it matches
+func expectHeader(t *testing.T, br *bufio.Reader, expect header) {
+	hdr, err := readHeader(br)
+	if err != nil {
+		t.Fatalf("readHeader failed: %v", err)
+	}
+	if *hdr != expect {
+		t.Fatalf("expected header [%v], got [%v]", expect, *hdr)
+	}
+}
+
+// Read the rest (body) and verify that it matches
+func expectRest(t *testing.T, br *bufio.Reader, expect string) {
+	p, _ := io.ReadAll(br)
+	rest := string(p)
+	if rest != expect {
+		t.Errorf("expected rest [hello], got [%v]", rest)
+	}
+}
+
+// Check regular rdv headers
+func TestReadHeader(t *testing.T) {
+	tests := map[string]struct {
+		input string
+		hdr   header
+		rest  string
+	}{
+		"dial_rest":       {input: "rdv/1 DIAL abc\nhello", hdr: header{"DIAL", "abc"}, rest: "hello"},
+		"accept_rest":     {input: "rdv/1 ACCEPT abc\nhello", hdr: header{"ACCEPT", "abc"}, rest: "hello"},
+		"crlf_whitespace": {input: "rdv/1  DIAL  abc \r\n\nhello", hdr: header{"DIAL", "abc"}, rest: "\nhello"},
+		"rest_empty":      {input: "rdv/1 DIAL abc\n", hdr: header{"DIAL", "abc"}},
+		"path_encoded":    {input: "rdv/1 DIAL ab%20c\n", hdr: header{"DIAL", "ab c"}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+
+			br := bufio.NewReader(bytes.NewBufferString(tc.input))
+			expectHeader(t, br, tc.hdr)
+			expectRest(t, br, tc.rest)
+		})
+	}
+}
+
+func TestReadHeaderErr(t *testing.T) {
+	tests := map[string]struct {
+		input string
+		err   error
+	}{
+		"empty":          {input: "", err: io.EOF},
+		"no_lf":          {input: "rdv/1 DIAL abc", err: io.ErrUnexpectedEOF},
+		"empty_line":     {input: "\nrdv/1 DIAL abc\n", err: ErrProtocol},
+		"proto_mismatch": {input: "rdv/2 DIAL abc\n", err: ErrProtocol},
+		"no_token":       {input: "rdv/1 DIAL\n", err: ErrProtocol},
+		"double_token":   {input: "rdv/1 DIAL abc def\n", err: ErrProtocol},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			br := bufio.NewReader(bytes.NewBufferString(tc.input))
+			hdr, err := readHeader(br)
+			if !errors.Is(err, tc.err) {
+				t.Errorf("expected [%v], got hdr=%v err=[%v]", tc.err, hdr, err)
+			}
+		})
+	}
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	tests := map[string]struct {
+		hdr  header
+		rest string
+	}{
+		"dial_rest":     {hdr: header{"DIAL", "abc"}, rest: "hello"},
+		"accept_rest":   {hdr: header{"ACCEPT", "abc"}, rest: "hello"},
+		"rest_empty":    {hdr: header{"DIAL", "abc"}},
+		"special_chars": {hdr: header{"DIAL", "abc-. +\ndef"}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+
+			buf := bytes.NewBuffer(nil)
+			err := writeHeader(buf, tc.hdr)
+			if err != nil {
+				t.Fatalf("failed writeHeader: %v", err)
+			}
+			_, err = buf.WriteString(tc.rest)
+			if err != nil {
+				t.Fatalf("failed writeString: %v", err)
+			}
+			br := bufio.NewReader(buf)
+			expectHeader(t, br, tc.hdr)
+			expectRest(t, br, tc.rest)
+		})
+	}
+}
+
+func TestReadHeaderShort(t *testing.T) {
+	br := bufio.NewReader(bytes.NewBufferString("rdv/1 DIAL\nyo"))
+	_, err := readHeader(br)
+	if !errors.Is(err, ErrProtocol) {
+		t.Errorf("expected protocol err, got [%v]", err)
+	}
+}
+
+// Read CONTINUE command
+func TestReadCmdContinue(t *testing.T) {
+	br := bufio.NewReader(bytes.NewBufferString("CONTINUE\n"))
+	err := readCmdContinue(br)
+	if err != nil {
+		t.Fatalf("readCmdContinue failed: %v", err)
+	}
+}
+
+// Read OTHER command
+func TestReadCmdOther(t *testing.T) {
+	br := bufio.NewReader(bytes.NewBufferString("OTHER 1.2.3.4:567\n"))
+	err := readCmdContinue(br)
+
+	other, ok := err.(ErrOther)
+	if !ok {
+		t.Fatalf("expected ErrOther, got: %v", err)
+	}
+	expect := netip.MustParseAddrPort("1.2.3.4:567")
+	if other.Addr != expect {
+		t.Fatalf("expected %v, got %v", expect, other.Addr)
+	}
+}
@@ -0,0 +1,10 @@
+module github.com/betamos/rdv
+
+go 1.22
+
+require (
+	github.com/libp2p/go-reuseport v0.4.0
+	golang.org/x/net v0.24.0
+)
+
+require golang.org/x/sys v0.19.0 // indirect
@@ -0,0 +1,115 @@
+package rdv
+
+import (
+	"errors"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func testParseRequest(t *testing.T, m Meta) {
+	r, err := newRdvRequest(&m, "/", nil)
+	if err != nil {
+		t.Fatalf("failed newRdvRequest: %v", err)
+	}
+	m2, err := parseRdvRequest(r)
+	if err != nil {
+		t.Fatalf("failed parseRdvRequest: %v", err)
+	}
+	if !reflect.DeepEqual(m, *m2) {
+		t.Errorf("expected [%v], got [%v]", m, *m2)
+	}
+}
+
+func TestParseRequest(t *testing.T) {
+	m := Meta{
+		Method: ACCEPT,
+		Token:  "abc",
+		SelfAddrs: []netip.AddrPort{
+			netip.MustParseAddrPort("127.0.0.1:1234"),
+			netip.MustParseAddrPort("[::1]:1234"),
+		},
+	}
+	testParseRequest(t, m)
+}
+
+func TestParseRequestNoSelfAddrs(t *testing.T) {
+	m := Meta{Method: DIAL, Token: "abc"}
+	testParseRequest(t, m)
+}
+
+func TestParseRequestWrongUpgrade(t *testing.T) {
+	m := Meta{Method: DIAL, Token: "abc"}
+	r, err := newRdvRequest(&m, "host", nil)
+	if err != nil {
+		t.Fatalf("failed newRdvRequest: %v", err)
+	}
+	r.Header.Set("Upgrade", "websocket")
+	_, err = parseRdvRequest(r)
+	if !errors.Is(err, errUpgrade) {
+		t.Fatal("expected upgrade error, got nil")
+	}
+}
+
+func TestParseRequestWrongMethod(t *testing.T) {
+	m := Meta{Method: "GET", Token: "abc"}
+	r, err := newRdvRequest(&m, "host", nil)
+	if err != nil {
+		t.Fatalf("failed newRdvRequest: %v", err)
+	}
+	r.Header.Del("Upgrade")
+	_, err = parseRdvRequest(r)
+	if !errors.Is(err, errUpgrade) {
+		t.Fatal("expected upgrade error, got nil")
+	}
+}
+
+func TestParseRequestNoToken(t *testing.T) {
+	m := Meta{Method: DIAL}
+	r, err := newRdvRequest(&m, "host", nil)
+	if err != nil {
+		t.Fatalf("failed newRdvRequest: %v", err)
+	}
+	r.Header.Del("Upgrade")
+	_, err = parseRdvRequest(r)
+	if !errors.Is(err, errUpgrade) {
+		t.Fatalf("expected upgrade error, got: %v", err)
+	}
+}
+
+func testParseResponse(t *testing.T, m Meta) {
+	// Add synthetic fields to make sure they're preserved
+	m.Method = DIAL
+	m.Token = "abc"
+	m2 := Meta{Method: DIAL, Token: "abc"}
+	r := newRdvResponse(&m)
+	err := parseRdvResponse(&m2, r)
+	if err != nil {
+		t.Fatalf("failed parseRdvResponse: %v", err)
+	}
+	if !reflect.DeepEqual(m, m2) {
+		t.Errorf("expected [%v], got [%v]", m, m2)
+	}
+}
+
+func TestParseResponse(t *testing.T) {
+	obs := netip.MustParseAddrPort("[::2]:1234")
+	m := Meta{
+		PeerAddrs: []netip.AddrPort{
+			netip.MustParseAddrPort("127.0.0.1:1234"),
+			netip.MustParseAddrPort("[::1]:1234"),
+		},
+		ObservedAddr: &obs,
+	}
+	testParseResponse(t, m)
+}
+
+func TestParseResponseWrongUpgrade(t *testing.T) {
+	m := Meta{Method: DIAL, Token: "abc"}
+	r := newRdvResponse(&m)
+	r.Header.Set("Upgrade", "websocket")
+	err := parseRdvResponse(&m, r)
+	if !errors.Is(err, ErrBadHandshake) {
+		t.Fatalf("expected upgrade error, got: %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package rdv
+
+import (
+	"cmp"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Lobby matches pairs of dial and accept conns with the same token. The server adds upgraded
+// conns to the lobby, and serves the pairs that are matched.
+//
+// Custom implementations can share the lobby between servers, see [ClusterLobby].
+type Lobby interface {
+	// Runs the lobby until Shutdown, invoking match for each pair. Conns still idle upon
+	// shutdown are evicted with an http error before returning.
+	Serve(match func(dc, ac *Conn))
+
+	// Adds an upgraded conn to the lobby, which takes ownership of it. The response has not been
+	// written. Not called after Shutdown.
+	Join(conn *Conn)
+
+	// Stops the lobby, which causes Serve to return. Must not block.
+	Shutdown()
+}
+
+// MemoryLobby is an in-process [Lobby], for a single server. The zero-value is valid.
+type MemoryLobby struct {
+	// Amount of time that on peer can wait in the lobby for its partner. Zero means no timeout.
+	Timeout time.Duration
+
+	// Optional logger to use.
+	Logger *slog.Logger
+
+	log    *slog.Logger
+	idle   map[string]*Conn
+	connCh chan *Conn // Incoming upgraded conns: request received, no response sent, no deadline
+
+	monCh chan string // token sent when current conn mapping is complete
+	once  sync.Once
+}
+
+func (l *MemoryLobby) init() {
+	l.once.Do(func() {
+		l.monCh = make(chan string, 8)
+		l.idle = make(map[string]*Conn)
+		l.connCh = make(chan *Conn, 8)
+		l.log = cmp.Or(l.Logger, nopLogger)
+	})
+}
+
+func (l *MemoryLobby) Join(conn *Conn) {
+	l.init()
+	l.connCh <- conn
+}
+
+func (l *MemoryLobby) Shutdown() {
+	l.init()
+	close(l.connCh)
+}
+
+func (l *MemoryLobby) Serve(match func(dc, ac *Conn)) {
+	l.init()
+loop:
+	for {
+		select {
+
+		case token := <-l.monCh:
+			l.kickOut(token)
+		case conn, ok := <-l.connCh:
+			if !ok {
+				break loop
+			}
+			idleConn := l.interruptAndGetIdle(conn.Token)
+			// invariant: the idle conn is removed and no longer monitored
+			if idleConn != nil && idleConn.Method != conn.Method {
+				// happy path: the conn and idle conn are a match
+				idleConn.SetDeadline(time.Time{})
+				// Methods are unequal, we found a pair
+				dc, ac := idleConn, conn
+				if ac.Method == DIAL {
+					dc, ac = ac, dc // swap
+				}
+
+				// Exchange addrs
+				dc.PeerAddrs = ac.selfAndObservedAddrs()
+				ac.PeerAddrs = dc.selfAndObservedAddrs()
+				match(dc, ac)
+				continue
+			}
+			// either there is no conn of the same token, or there's another of the same method
+			l.addIdle(conn)
+			// if conn is same method, kick the old one out
+			if idleConn == nil {
+				l.log.Debug("rdv: joined", "token", conn.Token, "addr", conn.ObservedAddr)
+			} else {
+				l.log.Debug("rdv: replaced", "client", conn.Token, "addr", conn.ObservedAddr)
+				writeResponseErr(idleConn, http.StatusConflict, "replaced by another conn")
+			}
+		}
+	}
+	l.log.Info("rdv: shutting down", "lobby_conns", len(l.idle))
+	for _, ic := range l.idle {
+		// This forces all idle conns to finish quickly
+		writeResponseErr(ic, http.StatusServiceUnavailable, "rdv server shutting down, try again")
+	}
+	for len(l.idle) > 0 {
+		delete(l.idle, <-l.monCh) // This should be an exact match, but it's arguably fragile
+	}
+}
+
+func (l *MemoryLobby) addIdle(conn *Conn) {
+	if l.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(l.Timeout))
+	}
+	l.idle[conn.Token] = conn
+	// No waitgroup needed here since the monCh is drained until no more idle conns
+	go func() {
+		n, err := conn.Read(make([]byte, 1))
+		if !(n == 0 && errors.Is(err, os.ErrDeadlineExceeded)) {
+			writeResponseErr(conn, http.StatusBadRequest, "conn must idle while waiting for response header")
+		}
+		l.monCh <- conn.Token
+	}()
+}
+
+// If there's an idle conn for the token, cancel it and await its monitoring, then return it
+func (l *MemoryLobby) interruptAndGetIdle(token string) *Conn {
+	conn := l.idle[token]
+	if conn == nil {
+		return nil
+	}
+	// cancel the monitoring
+	conn.SetDeadline(time.Now())
+
+	// wait for the monitoring to complete, which must happen very quickly
+	for t := range l.monCh {
+		// our conn's monitoring completed
+		if t == token {
+			break
+		}
+		// an unrelated conn's monitoring failed, kick it out until we get to ours
+		l.kickOut(t)
+	}
+	delete(l.idle, token)
+	return conn
+}
+
+// kick out of the lobby either from a timeout or breaking the protocol
+func (l *MemoryLobby) kickOut(token string) {
+	conn := l.idle[token]
+	delete(l.idle, token)
+	// If there was a previous protocol error, this won't do anything because the conn is closed
+	writeResponseErr(conn, http.StatusRequestTimeout, "no matching peer found")
+	l.log.Debug("rdv: client timed out", "token", conn.Token, "addr", conn.ObservedAddr)
+}
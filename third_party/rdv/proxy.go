@@ -0,0 +1,220 @@
+package rdv
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ErrProxy is returned when an outbound proxy refuses or fails to tunnel to the rdv server.
+var ErrProxy = errors.New("rdv proxy error")
+
+// Returns the proxy to use for the rdv server addr, or nil for a direct conn.
+func (c *Client) proxyFor(addr string) (*url.URL, error) {
+	if c.Proxy == nil {
+		return nil, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Proxy(req)
+}
+
+// Returns a function which dials rdv server urls through the proxy, including TLS for https.
+// Proxied conns don't use the reuseport socket, since p2p is impossible anyway.
+func proxyDialer(proxy *url.URL, tlsConf *tls.Config) func(context.Context, *url.URL) (net.Conn, error) {
+	return func(ctx context.Context, u *url.URL) (net.Conn, error) {
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("unexpected scheme [%s]", u.Scheme)
+		}
+		nc, err := dialProxy(ctx, proxy, net.JoinHostPort(u.Hostname(), urlPort(u)))
+		if err != nil || u.Scheme == "http" {
+			return nc, err
+		}
+		conf := tlsConf.Clone()
+		if conf == nil {
+			conf = new(tls.Config)
+		}
+		if conf.ServerName == "" {
+			conf.ServerName = u.Hostname()
+		}
+		tc := tls.Client(nc, conf)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		return tc, nil
+	}
+}
+
+// Dials the host:port through an HTTP CONNECT (http, https) or SOCKS5 (socks5, socks5h) proxy.
+// Credentials are taken from the proxy url, if any.
+func dialProxy(ctx context.Context, proxy *url.URL, hostPort string) (net.Conn, error) {
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", net.JoinHostPort(proxy.Hostname(), urlPort(proxy)))
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		nc.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	switch proxy.Scheme {
+	case "https":
+		tc := tls.Client(nc, &tls.Config{ServerName: proxy.Hostname()})
+		nc = tc
+		fallthrough
+	case "http":
+		err = connectHttp(nc, proxy, hostPort)
+	case "socks5", "socks5h":
+		err = connectSocks5(ctx, nc, proxy, hostPort)
+	default:
+		err = fmt.Errorf("%w: unsupported scheme [%s]", ErrProxy, proxy.Scheme)
+	}
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return nc, nil
+}
+
+// Establishes a tunnel with an HTTP CONNECT request.
+func connectHttp(nc net.Conn, proxy *url.URL, hostPort string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: hostPort},
+		Host:   hostPort,
+		Header: make(http.Header),
+	}
+	if user := proxy.User; user != nil {
+		pass, _ := user.Password()
+		cred := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+	br := bufio.NewReader(nc)
+	resp, err := doHttp(nc, br, req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: connect: %v", ErrProxy, resp.Status)
+	}
+	// The server speaks first after upgrades, so nothing should be buffered yet
+	if br.Buffered() > 0 {
+		return fmt.Errorf("%w: unexpected data after connect", ErrProxy)
+	}
+	return nil
+}
+
+// Establishes a tunnel with a SOCKS5 CONNECT command (RFC 1928), with optional
+// username/password auth (RFC 1929). The socks5h scheme resolves names at the proxy.
+func connectSocks5(ctx context.Context, nc net.Conn, proxy *url.URL, hostPort string) error {
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return err
+	}
+
+	// Method negotiation
+	methods := []byte{0x00} // no auth
+	if proxy.User != nil {
+		methods = append(methods, 0x02) // username/password
+	}
+	if _, err := nc.Write(append([]byte{5, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(nc, reply[:]); err != nil {
+		return err
+	}
+	switch {
+	case reply[0] != 5:
+		return fmt.Errorf("%w: bad socks version %d", ErrProxy, reply[0])
+	case reply[1] == 0x02 && proxy.User != nil:
+		user := proxy.User.Username()
+		pass, _ := proxy.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return fmt.Errorf("%w: socks credentials too long", ErrProxy)
+		}
+		msg := append([]byte{1, byte(len(user))}, user...)
+		msg = append(append(msg, byte(len(pass))), pass...)
+		if _, err := nc.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(nc, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return fmt.Errorf("%w: socks auth failed", ErrProxy)
+		}
+	case reply[1] != 0x00:
+		return fmt.Errorf("%w: no acceptable socks auth method", ErrProxy)
+	}
+
+	// Connect command
+	msg := []byte{5, 1, 0}
+	addr, err := netip.ParseAddr(host)
+	if err != nil && proxy.Scheme == "socks5" {
+		addrs, lerr := net.DefaultResolver.LookupNetIP(ctx, "ip4", host)
+		if lerr != nil {
+			return lerr
+		}
+		addr, err = addrs[0], nil
+	}
+	switch {
+	case err != nil: // Resolved by the proxy
+		if len(host) > 255 {
+			return fmt.Errorf("%w: host name too long", ErrProxy)
+		}
+		msg = append(append(msg, 3, byte(len(host))), host...)
+	case addr.Is4():
+		msg = append(append(msg, 1), addr.AsSlice()...)
+	default:
+		msg = append(append(msg, 4), addr.AsSlice()...)
+	}
+	msg = binary.BigEndian.AppendUint16(msg, uint16(port))
+	if _, err := nc.Write(msg); err != nil {
+		return err
+	}
+	var hdr [4]byte
+	if _, err := io.ReadFull(nc, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[1] != 0 {
+		return fmt.Errorf("%w: socks connect failed with code %d", ErrProxy, hdr[1])
+	}
+	// Discard the bound addr and port
+	var skip int
+	switch hdr[3] {
+	case 1:
+		skip = 4 + 2
+	case 4:
+		skip = 16 + 2
+	case 3:
+		var n [1]byte
+		if _, err := io.ReadFull(nc, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0]) + 2
+	default:
+		return fmt.Errorf("%w: bad socks addr type %d", ErrProxy, hdr[3])
+	}
+	_, err = io.ReadFull(nc, make([]byte, skip))
+	return err
+}
@@ -0,0 +1,145 @@
+package rdv
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Handler serves pairs of (dial- and accept) rdv conns.
+// The context is canceled when the server is closed.
+//
+// Custom implementations should use a [Relayer] to conform with the rdv protocol.
+type Handler interface {
+	Serve(ctx context.Context, dc, ac *Conn)
+}
+
+// An rdv server, which implements [net/http.Handler].
+type Server struct {
+	// Handler serves relay connections between the two peers. Can be customized to monitor,
+	// rate limit or set idle timeouts. If nil, a zero-value [Relayer] is used.
+	Handler Handler
+
+	// Amount of time that on peer can wait in the lobby for its partner. Zero means no timeout.
+	// Only used by the default lobby.
+	LobbyTimeout time.Duration
+
+	// Lobby matches dial and accept conns. If nil, a [MemoryLobby] is used.
+	Lobby Lobby
+
+	// Function that extracts the observed addr from requests. If nil, r.RemoteAddr is parsed.
+	//
+	// If your server is behind a load balancer, reverse proxy or similar, you may need to configure
+	// forwarding headers and provide a custom function. See the server setup guide for details.
+	ObservedAddrFunc func(r *http.Request) (netip.AddrPort, error)
+
+	// Optional logger to use.
+	Logger *slog.Logger
+
+	log    *slog.Logger // Set at start-time. Same as Logger or nopLogger if nil.
+	lobby  Lobby        // Set at start-time. Same as Lobby or a MemoryLobby if nil.
+	cancel context.CancelCauseFunc
+
+	// Guards the lobby because Go's HTTP server leaks handler goroutines of hijacked connections.
+	// There is *no way* to determine when those handlers are complete.
+	// See https://github.com/golang/go/issues/57673
+	closed bool
+	mu     sync.RWMutex
+	wg     sync.WaitGroup
+}
+
+// Start rdv server goroutines which manages upgrades and handler invocations.
+func (s *Server) Start() {
+	s.log = cmp.Or(s.Logger, nopLogger)
+	s.lobby = cmp.Or[Lobby](s.Lobby, &MemoryLobby{Timeout: s.LobbyTimeout, Logger: s.log})
+	var ctx context.Context
+	ctx, s.cancel = context.WithCancelCause(context.Background())
+
+	handler := cmp.Or[Handler](s.Handler, new(Relayer))
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.lobby.Serve(func(dc, ac *Conn) {
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				handler.Serve(ctx, dc, ac)
+			}()
+		})
+	}()
+}
+
+// Calls [Server.Upgrade] and logs the error, if any.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := s.Upgrade(w, r)
+	if err != nil {
+		s.log.Info("rdv: bad request", "request", r.URL, "err", err)
+	}
+}
+
+// Upgrades the request and adds the client to the lobby for matching. Returns an
+// [ErrBadHandshake] error if the upgrade failed, or [net/http.ErrServerClosed] if closed.
+// An http error is written to the client if an error occurs.
+func (s *Server) Upgrade(w http.ResponseWriter, r *http.Request) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.lobby == nil && false {
+		panic("rdv: server uninitialized, use server.Start()")
+	}
+	if s.closed {
+		http.Error(w, "rdv is closed", http.StatusServiceUnavailable)
+		return http.ErrServerClosed
+	}
+	conn, err := upgradeRdv(w, r)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadHandshake, err)
+	}
+	s.addObservedAddr(conn)
+	s.lobby.Join(conn)
+	return nil
+}
+
+func (s *Server) addObservedAddr(conn *Conn) {
+	fn := s.ObservedAddrFunc
+	if fn == nil {
+		fn = parseRemoteAddr
+	}
+	if observedAddr, err := fn(conn.Request); err != nil {
+		s.log.Warn("rdv: could not get observed addr", "err", err)
+	} else {
+		conn.ObservedAddr = &observedAddr
+	}
+}
+
+// Parses the ip:port from r.RemoteAddr
+func parseRemoteAddr(r *http.Request) (netip.AddrPort, error) {
+	return netip.ParseAddrPort(r.RemoteAddr)
+}
+
+// Evict all clients from lobby and cancels the context passed to handlers.
+// After this, clients are rejected with a 503 error.
+// Suitable for use with [http.Server.RegisterOnShutdown].
+// Use [Server.Close] to wait for all handlers to complete.
+func (s *Server) Shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.lobby.Shutdown()
+	s.cancel(http.ErrServerClosed)
+	s.closed = true
+}
+
+// Calls [Server.Shutdown] and waits for handlers and internal goroutines to finish.
+// Safe to call multiple times.
+func (s *Server) Close() error {
+	s.Shutdown()
+	s.wg.Wait()
+	return nil
+}
@@ -0,0 +1,13 @@
+package rdv
+
+import (
+	"net/http"
+)
+
+func ExampleServer() {
+	// Run a plain rdv server without other endpoints
+	srv := &Server{}
+	srv.Start()
+	defer srv.Close()
+	http.ListenAndServe(":8080", srv)
+}
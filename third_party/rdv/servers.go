@@ -0,0 +1,183 @@
+package rdv
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Max time to probe the latency of rdv servers, see [Client.DoAny].
+const probeTimeout = 2 * time.Second
+
+// Selection is a rule for choosing among several rdv servers, such that both peers meet at the
+// same server.
+type Selection int
+
+const (
+	// Both peers rank the reachable servers by a hash of the token, and use the first one.
+	// Tokens are spread evenly across servers, regardless of where the peers are.
+	SelectHash Selection = iota
+
+	// The dialer uses the reachable server with the lowest rtt, e.g. the nearest region, and
+	// the accepter waits at all reachable servers at once. Suitable when dialers are near the
+	// accepter, or the accepter is long-lived.
+	SelectRTT
+)
+
+// The result of probing an rdv server.
+type serverProbe struct {
+	addr string
+	rtt  time.Duration
+	err  error
+}
+
+// Connect with another peer through one of several rdv servers, e.g. in different regions.
+// Servers are probed for latency and reachability, and chosen according to the
+// [Client.Selection] rule. If a server is down, the next one in order is used.
+//
+// Both peers must provide the same servers. Peers converge as long as they agree on which servers
+// are reachable; use [Client.Timeout] or a server lobby timeout to recover from disagreements.
+// See [Client.Do] for the other arguments.
+func (c *Client) DoAny(ctx context.Context, method string, addrs []string, token string, header http.Header) (*Conn, *http.Response, error) {
+	if len(addrs) == 1 {
+		return c.Do(ctx, method, addrs[0], token, header)
+	}
+	log := cmp.Or(c.Logger, nopLogger).With("token", token)
+	probes := c.probeServers(ctx, addrs)
+	var reachable, unreachable []serverProbe
+	for _, p := range probes {
+		if p.err != nil {
+			log.Debug("rdv: server unreachable", "addr", p.addr, "err", unwrapOp(p.err))
+			unreachable = append(unreachable, p)
+		} else {
+			log.Debug("rdv: server probed", "addr", p.addr, "rtt", p.rtt)
+			reachable = append(reachable, p)
+		}
+	}
+	if c.Selection == SelectRTT && method == ACCEPT && len(reachable) > 0 {
+		return c.acceptAll(ctx, reachable, token, header)
+	}
+	order := rankByHash(addrs, token)
+	if c.Selection == SelectRTT {
+		slices.SortStableFunc(reachable, func(a, b serverProbe) int {
+			return cmp.Compare(a.rtt, b.rtt)
+		})
+	} else {
+		slices.SortStableFunc(reachable, func(a, b serverProbe) int {
+			return cmp.Compare(slices.Index(order, a.addr), slices.Index(order, b.addr))
+		})
+	}
+	// Unreachable servers are tried last, in case the probe failed spuriously
+	slices.SortStableFunc(unreachable, func(a, b serverProbe) int {
+		return cmp.Compare(slices.Index(order, a.addr), slices.Index(order, b.addr))
+	})
+	var (
+		conn *Conn
+		resp *http.Response
+		err  error
+	)
+	for _, p := range append(reachable, unreachable...) {
+		log.Debug("rdv: server selected", "addr", p.addr, "rtt", p.rtt)
+		conn, resp, err = c.Do(ctx, method, p.addr, token, header)
+		if err == nil || !isServerDown(ctx, resp) {
+			return conn, resp, err
+		}
+		log.Warn("rdv: server failed, trying next", "addr", p.addr, "err", err)
+	}
+	return conn, resp, err
+}
+
+// Reports whether to fall back to the next server after an error. Responses other than 5xx are
+// from a working server, and falling back would make the peers diverge.
+func isServerDown(ctx context.Context, resp *http.Response) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	return resp == nil || resp.StatusCode >= 500
+}
+
+// Accepts at all the servers simultaneously, and returns the first peer conn.
+func (c *Client) acceptAll(ctx context.Context, probes []serverProbe, token string, header http.Header) (*Conn, *http.Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn *Conn
+		resp *http.Response
+		err  error
+	}
+	results := make(chan result, len(probes))
+	for _, p := range probes {
+		go func(addr string) {
+			conn, resp, err := c.Do(ctx, ACCEPT, addr, token, header)
+			results <- result{conn, resp, err}
+		}(p.addr)
+	}
+	var last result
+	for range probes {
+		r := <-results
+		if r.err != nil {
+			last = r
+			continue
+		}
+		cancel()
+		// Close late winners, which are unlikely but possible
+		go func(n int) {
+			for ; n > 0; n-- {
+				if r := <-results; r.conn != nil {
+					r.conn.Close()
+				}
+			}
+		}(len(probes) - 1)
+		return r.conn, r.resp, nil
+	}
+	return last.conn, last.resp, last.err
+}
+
+// Measures the tcp connect time to each server in parallel, through the proxy if any.
+func (c *Client) probeServers(ctx context.Context, addrs []string) []serverProbe {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	probes := make([]serverProbe, len(addrs))
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		probes[i].addr = addr
+		wg.Add(1)
+		go func(p *serverProbe) {
+			defer wg.Done()
+			t0 := time.Now()
+			nc, err := c.dialProbe(ctx, p.addr)
+			p.rtt, p.err = time.Since(t0), err
+			if err == nil {
+				nc.Close()
+			}
+		}(&probes[i])
+	}
+	wg.Wait()
+	return probes
+}
+
+func (c *Client) dialProbe(ctx context.Context, addr string) (net.Conn, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unexpected scheme [%s]", u.Scheme)
+	}
+	hostPort := net.JoinHostPort(u.Hostname(), urlPort(u))
+	proxy, err := c.proxyFor(addr)
+	if err != nil {
+		return nil, err
+	}
+	if proxy != nil {
+		return dialProxy(ctx, proxy, hostPort)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp4", hostPort)
+}
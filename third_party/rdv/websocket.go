@@ -0,0 +1,289 @@
+package rdv
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The websocket binding tunnels the rdv handshake and relay bytes over a standard websocket,
+// for middleboxes that refuse the rdv upgrade or the DIAL and ACCEPT methods. The request is
+// a GET with the rdv method in a header, and all bytes after the 101 response are sent as
+// binary websocket messages. Servers accept both bindings, and the relay is agnostic to them.
+const (
+	// The rdv method of a websocket request, which always uses GET. Request only.
+	hMethod = "Rdv-Method"
+
+	wsProtocol = "websocket"
+	wsVersion  = "13"
+	wsGUID     = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	// Websocket opcodes, see RFC 6455 section 5.2
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+
+	// Max payload of control frames
+	wsMaxControl = 125
+)
+
+var errWebSocket = errors.New("websocket protocol error")
+
+// Reports whether a refused native upgrade should be retried over websocket: the method was
+// refused (405, 501), or the upgrade was, e.g. by a proxy stripping the upgrade headers, to which
+// rdv servers respond with 426. Other errors, such as a rejected token, aren't retried, since
+// the binding has nothing to do with them.
+func fallbackToWebSocket(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented, http.StatusUpgradeRequired:
+		return true
+	}
+	return false
+}
+
+// Reports whether the headers request or confirm a websocket upgrade.
+func isWebSocket(h http.Header) bool {
+	return strings.EqualFold(strings.TrimSpace(h.Get("Upgrade")), wsProtocol)
+}
+
+// Returns an rdv request over the websocket binding
+func newWebSocketRequest(meta *Meta, addr string, header http.Header) (*http.Request, error) {
+	req, err := newRdvRequest(meta, addr, header)
+	if err != nil {
+		return nil, err
+	}
+	var key [16]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, err
+	}
+	req.Method = http.MethodGet
+	setUpgradeHeaders(req.Header, wsProtocol)
+	req.Header.Set(hMethod, meta.Method)
+	req.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key[:]))
+	req.Header.Set("Sec-WebSocket-Version", wsVersion)
+	req.Header.Set("Sec-WebSocket-Protocol", protocolName)
+	return req, nil
+}
+
+// Checks the websocket upgrade headers of a request and returns the rdv method.
+func checkWebSocketRequest(req *http.Request) (string, error) {
+	if req.Method != http.MethodGet {
+		return "", fmt.Errorf("%w: websocket requires GET", errUpgrade)
+	}
+	if !headerHasToken(req.Header, "Connection", "upgrade") {
+		return "", fmt.Errorf("%w: requires connection upgrade", errUpgrade)
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != wsVersion {
+		return "", fmt.Errorf("%w: unsupported websocket version", errUpgrade)
+	}
+	if key, err := base64.StdEncoding.DecodeString(req.Header.Get("Sec-WebSocket-Key")); err != nil || len(key) != 16 {
+		return "", fmt.Errorf("%w: bad websocket key", errUpgrade)
+	}
+	if !headerHasToken(req.Header, "Sec-WebSocket-Protocol", protocolName) {
+		return "", fmt.Errorf("%w: websocket subprotocol must be %s", errUpgrade, protocolName)
+	}
+	return req.Header.Get(hMethod), nil
+}
+
+// Sets the websocket headers of a 101 response to the request
+func setWebSocketResponseHeaders(h http.Header, req *http.Request) {
+	setUpgradeHeaders(h, wsProtocol)
+	h.Set("Sec-WebSocket-Accept", webSocketAccept(req.Header.Get("Sec-WebSocket-Key")))
+	h.Set("Sec-WebSocket-Protocol", protocolName)
+}
+
+// Checks the websocket headers of a 101 response to the request
+func checkWebSocketResponse(resp *http.Response, req *http.Request) error {
+	if !isWebSocket(resp.Header) || !headerHasToken(resp.Header, "Connection", "upgrade") {
+		return fmt.Errorf("%w: bad websocket upgrade", ErrBadHandshake)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(req.Header.Get("Sec-WebSocket-Key")) {
+		return fmt.Errorf("%w: bad websocket accept", ErrBadHandshake)
+	}
+	if resp.Header.Get("Sec-WebSocket-Protocol") != protocolName {
+		return fmt.Errorf("%w: bad websocket subprotocol", ErrBadHandshake)
+	}
+	return nil
+}
+
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Reports whether a comma-separated header contains the token, case-insensitively
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A net.Conn which frames writes as binary websocket messages and reads the payload of
+// data messages. Pings are answered and close frames end the stream. Clients mask their
+// frames, as required by RFC 6455.
+type wsConn struct {
+	net.Conn
+	br     *bufio.Reader
+	client bool
+
+	// Read state of the current frame
+	remaining int64
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+
+	wmu sync.Mutex // Guards writes, since pongs are written from the reader
+}
+
+func newWsConn(nc net.Conn, br *bufio.Reader, client bool) *wsConn {
+	return &wsConn{Conn: nc, br: br, client: client}
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextDataFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.br.Read(p)
+	if c.masked {
+		for i := range p[:n] {
+			p[i] ^= c.mask[(c.maskPos+i)%4]
+		}
+		c.maskPos = (c.maskPos + n) % 4
+	}
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// Reads frame headers until a data frame, handling control frames along the way.
+func (c *wsConn) nextDataFrame() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		return err
+	}
+	op := hdr[0] & 0xf
+	c.masked = hdr[1]&0x80 != 0
+	length := int64(hdr[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]) & (1<<63 - 1))
+	}
+	if c.masked {
+		if _, err := io.ReadFull(c.br, c.mask[:]); err != nil {
+			return err
+		}
+	}
+	c.maskPos = 0
+	switch op {
+	case wsOpContinuation, wsOpText, wsOpBinary:
+		c.remaining = length
+		return nil
+	case wsOpPing, wsOpPong, wsOpClose:
+	default:
+		return fmt.Errorf("%w: unknown opcode %d", errWebSocket, op)
+	}
+	if length > wsMaxControl {
+		return fmt.Errorf("%w: control frame too large", errWebSocket)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return err
+	}
+	if c.masked {
+		for i := range payload {
+			payload[i] ^= c.mask[i%4]
+		}
+	}
+	switch op {
+	case wsOpPing:
+		_, err := c.writeFrame(wsOpPong, payload)
+		return err
+	case wsOpClose:
+		return io.EOF
+	}
+	return nil
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return c.writeFrame(wsOpBinary, p)
+}
+
+// Writes a single, final frame and returns the number of payload bytes written.
+func (c *wsConn) writeFrame(op byte, p []byte) (int, error) {
+	buf := make([]byte, 0, 14+len(p))
+	buf = append(buf, 0x80|op)
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch {
+	case len(p) < 126:
+		buf = append(buf, maskBit|byte(len(p)))
+	case len(p) <= 0xffff:
+		buf = append(buf, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(p)))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(len(p)))
+	}
+	hdrLen := len(buf)
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return 0, err
+		}
+		buf = append(buf, mask[:]...)
+		hdrLen += 4
+		for i, b := range p {
+			buf = append(buf, b^mask[i%4])
+		}
+	} else {
+		buf = append(buf, p...)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	n, err := c.Conn.Write(buf)
+	return max(n-hdrLen, 0), err
+}
+
+// Sends a close frame, with a short deadline, and closes the conn.
+func (c *wsConn) Close() error {
+	c.Conn.SetWriteDeadline(time.Now().Add(shortWriteTimeout))
+	c.writeFrame(wsOpClose, nil)
+	return c.Conn.Close()
+}
@@ -0,0 +1,238 @@
+package rdv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testWsPair() (client, server *wsConn) {
+	c1, c2 := net.Pipe()
+	return newWsConn(c1, bufio.NewReader(c1), true), newWsConn(c2, bufio.NewReader(c2), false)
+}
+
+// Messages of all length encodings arrive intact in both directions, masked from the client.
+func TestWebSocketFraming(t *testing.T) {
+	client, server := testWsPair()
+	defer client.Close()
+	defer server.Close()
+	for _, size := range []int{1, 125, 126, 0xffff, 0x10000, 200000} {
+		data := make([]byte, size)
+		rand.Read(data)
+		for _, dir := range []struct {
+			name string
+			w, r *wsConn
+		}{{"client to server", client, server}, {"server to client", server, client}} {
+			errc := make(chan error, 1)
+			go func() {
+				_, err := dir.w.Write(data)
+				errc <- err
+			}()
+			got := make([]byte, size)
+			if _, err := io.ReadFull(dir.r, got); err != nil {
+				t.Fatalf("%s, %d bytes: read: %v", dir.name, size, err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatalf("%s, %d bytes: write: %v", dir.name, size, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("%s, %d bytes: payload differs", dir.name, size)
+			}
+		}
+	}
+}
+
+// The wire format of a client frame: fin and opcode, the mask bit, and a masked payload.
+func TestWebSocketClientFrame(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := newWsConn(c1, bufio.NewReader(c1), true)
+	go client.Write([]byte("hello"))
+	var frame [2 + 4 + 5]byte
+	if _, err := io.ReadFull(c2, frame[:]); err != nil {
+		t.Fatal(err)
+	}
+	if frame[0] != 0x80|wsOpBinary || frame[1] != 0x80|5 {
+		t.Fatalf("unexpected header % x", frame[:2])
+	}
+	mask := frame[2:6]
+	for i := range frame[6:] {
+		frame[6+i] ^= mask[i%4]
+	}
+	if string(frame[6:]) != "hello" {
+		t.Fatalf("unexpected payload %q", frame[6:])
+	}
+	c1.Close()
+	c2.Close()
+}
+
+// Appends a masked client frame.
+func appendClientFrame(b []byte, op byte, fin bool, payload []byte) []byte {
+	first := op
+	if fin {
+		first |= 0x80
+	}
+	b = append(b, first, 0x80|byte(len(payload)))
+	mask := [4]byte{1, 2, 3, 4}
+	b = append(b, mask[:]...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+	return b
+}
+
+// Pings are answered with a pong of the same payload, fragments are joined, and a close frame
+// ends the stream.
+func TestWebSocketControlFrames(t *testing.T) {
+	c1, c2 := net.Pipe()
+	server := newWsConn(c2, bufio.NewReader(c2), false)
+	defer server.Close()
+	var in []byte
+	in = appendClientFrame(in, wsOpBinary, false, []byte("hel"))
+	in = appendClientFrame(in, wsOpPing, true, []byte("p"))
+	in = appendClientFrame(in, wsOpContinuation, true, []byte("lo"))
+	in = appendClientFrame(in, wsOpClose, true, nil)
+	go c1.Write(in)
+
+	pong := make(chan []byte, 1)
+	go func() {
+		var b [3]byte
+		io.ReadFull(c1, b[:])
+		pong <- b[:]
+	}()
+	got, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Fatalf("expected hello, got %q", got)
+	}
+	if b := <-pong; !bytes.Equal(b, []byte{0x80 | wsOpPong, 1, 'p'}) {
+		t.Fatalf("unexpected pong % x", b)
+	}
+	c1.Close()
+}
+
+func TestWebSocketBadFrames(t *testing.T) {
+	for name, in := range map[string][]byte{
+		"unknown opcode":    appendClientFrame(nil, 0x3, true, nil),
+		"large control":     {0x80 | wsOpPing, 126, 0, 126},
+		"truncated payload": {0x80 | wsOpBinary, 5, 'a'},
+	} {
+		c1, c2 := net.Pipe()
+		server := newWsConn(c2, bufio.NewReader(c2), false)
+		go func() {
+			c1.Write(in)
+			c1.Close()
+		}()
+		var b [8]byte
+		n, err := io.ReadFull(server, b[:])
+		if err == nil {
+			t.Errorf("%s: read %d bytes without error", name, n)
+		}
+		c2.Close()
+	}
+}
+
+func TestFallbackToWebSocket(t *testing.T) {
+	for status, expect := range map[int]bool{
+		http.StatusMethodNotAllowed: true,
+		http.StatusUpgradeRequired:  true,
+		http.StatusNotImplemented:   true,
+		http.StatusBadRequest:       false,
+		http.StatusUnauthorized:     false,
+		http.StatusForbidden:        false,
+		http.StatusNotFound:         false,
+		http.StatusRequestTimeout:   false,
+		http.StatusConflict:         false,
+		http.StatusBadGateway:       false,
+	} {
+		if got := fallbackToWebSocket(&http.Response{StatusCode: status}); got != expect {
+			t.Errorf("status %d: expected %v, got %v", status, expect, got)
+		}
+	}
+}
+
+// Serves the rdv server behind a middlebox, which may refuse requests with a status.
+func testMiddlebox(t *testing.T, refuse func(*http.Request) int) (addr string, requests *atomic.Int32) {
+	server := &Server{}
+	server.Start()
+	requests = new(atomic.Int32)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if status := refuse(r); status != 0 {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		server.ServeHTTP(w, r)
+	}))
+	t.Cleanup(func() {
+		server.Close()
+		ts.Close()
+	})
+	return ts.URL + "/", requests
+}
+
+// A middlebox refusing the DIAL and ACCEPT methods makes the clients relay over websocket.
+func TestClientsWebSocketFallback(t *testing.T) {
+	addr, _ := testMiddlebox(t, func(r *http.Request) int {
+		if r.Method != http.MethodGet {
+			return http.StatusMethodNotAllowed
+		}
+		return 0
+	})
+	client := &Client{AddrSpaces: NoSpaces, Timeout: 2 * time.Second}
+	data := []byte("hello over websocket")
+	go func() {
+		ac, _, err := client.Accept(context.Background(), addr, "ws", nil)
+		if err != nil {
+			t.Errorf("accept failed: %v", err)
+			return
+		}
+		ac.Write(data)
+		ac.Close()
+	}()
+	dc, _, err := client.Dial(context.Background(), addr, "ws", nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	got, err := io.ReadAll(dc)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("expected %q, got %q", data, got)
+	}
+	if _, ok := client.wsAddrs.Load(addr); !ok {
+		t.Errorf("expected the websocket binding to be remembered")
+	}
+}
+
+// A rejected request isn't retried over websocket, nor is the binding remembered.
+func TestClientsNoFallbackOnForbidden(t *testing.T) {
+	addr, requests := testMiddlebox(t, func(r *http.Request) int {
+		return http.StatusForbidden
+	})
+	client := &Client{AddrSpaces: NoSpaces, Timeout: 2 * time.Second}
+	_, resp, err := client.Dial(context.Background(), addr, "forbidden", nil)
+	if err == nil || errors.Is(err, ErrBadHandshake) {
+		t.Fatalf("expected a status error, got %v", err)
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403, got %v", resp)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("expected 1 request, got %d", n)
+	}
+	if _, ok := client.wsAddrs.Load(addr); ok {
+		t.Errorf("expected no websocket binding")
+	}
+}
@@ -0,0 +1,188 @@
+package smux
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Protocol extensions are announced with a NOP frame, whose stream id carries extMagic and a
+// bitmask of the supported extensions. The announcement is the first frame of a session.
+// Peers without extension support ignore the stream id of NOPs, so they interoperate unchanged,
+// and an extension is only used once the peer has announced it too.
+const (
+	extMagic uint32 = 0x534d5800 // "SMX\x00"
+	extMask  uint32 = 0xff
+
+	// half-close with cmdCLW, see Stream.CloseWrite
+	extHalfClose uint32 = 1 << 0
+
+	// metadata as the payload of cmdSYN, see Session.OpenStreamWithMeta
+	extStreamMeta uint32 = 1 << 1
+
+	// version 2 streams within a version 1 session, see Config.StreamVersion
+	extStreamV2 uint32 = 1 << 2
+
+	// round trip time pings, see Session.RTT
+	extPing uint32 = 1 << 3
+)
+
+// goAwayMagic is the stream id of a NOP frame which tells the peer not to open new streams, see
+// Session.GoAway. Peers without support ignore it, like any NOP.
+const goAwayMagic uint32 = 0x474f4157 // "GOAW"
+
+// pingMagic and pongMagic are the stream ids of NOP frames which measure the round trip time, with
+// a sequence number in the low byte. Pings are only sent to peers which announced extPing.
+const (
+	pingMagic uint32 = 0x50494e00 // "PIN\x00"
+	pongMagic uint32 = 0x504f4e00 // "PON\x00"
+)
+
+// localExtensions returns the extensions enabled by the config
+func (s *Session) localExtensions() (ext uint32) {
+	if !s.config.HalfCloseDisabled {
+		ext |= extHalfClose
+	}
+	ext |= extStreamMeta | extPing
+	if s.config.Version == 1 && s.config.StreamVersion == 2 {
+		ext |= extStreamV2
+	}
+	return
+}
+
+// announceExtensions queues the announcement ahead of any other frame, without waiting for it
+// to be written, since the peer may not be reading yet.
+func (s *Session) announceExtensions() {
+	ext := s.localExtensions()
+	if ext == 0 {
+		return
+	}
+	req := writeRequest{
+		class:  CLSCTRL,
+		frame:  newFrame(byte(s.config.Version), cmdNOP, extMagic|ext),
+		seq:    atomic.AddUint32(&s.requestID, 1),
+		result: make(chan writeResult, 1),
+	}
+	select {
+	case s.shaper <- req:
+	case <-s.die:
+	}
+}
+
+// gotFrame records the peer's extensions, if announced, and notifies that the peer's first
+// frame has arrived. Called by recvLoop for every frame header.
+func (s *Session) gotFrame(hdr rawHeader) {
+	if hdr.Cmd() == cmdNOP {
+		sid := hdr.StreamID()
+		switch {
+		case sid&^extMask == extMagic:
+			atomic.StoreUint32(&s.peerExt, sid&extMask)
+			if sid&extPing != 0 {
+				go s.ping(nil)
+			}
+		case sid == goAwayMagic:
+			s.setGoAway()
+		case sid&^extMask == pingMagic:
+			// Answered in the background, since recvLoop mustn't wait for writes
+			go s.writeFrameInternal(newFrame(byte(s.config.Version), cmdNOP, pongMagic|sid&extMask), nil, CLSCTRL, nil)
+		case sid&^extMask == pongMagic:
+			s.pong(byte(sid))
+		}
+	}
+	s.peerHelloOnce.Do(func() {
+		close(s.chPeerHello)
+	})
+}
+
+// ping sends a ping, with a new sequence number, see pong.
+func (s *Session) ping(deadline <-chan time.Time) {
+	s.pingMu.Lock()
+	s.pingSeq++
+	sid := pingMagic | uint32(s.pingSeq)
+	s.pingSent = time.Now()
+	s.pingMu.Unlock()
+	s.writeFrameInternal(newFrame(byte(s.config.Version), cmdNOP, sid), deadline, CLSCTRL, nil)
+}
+
+// pong records the round trip time of the latest ping, if answered. Earlier pings are ignored.
+func (s *Session) pong(seq byte) {
+	s.pingMu.Lock()
+	defer s.pingMu.Unlock()
+	if seq == s.pingSeq && !s.pingSent.IsZero() {
+		s.rtt = time.Since(s.pingSent)
+		s.pingSent = time.Time{}
+	}
+}
+
+// RTT returns the round trip time of the latest answered ping, or 0 if none has been answered,
+// e.g. since the peer doesn't support pings. A ping is sent upon connecting, and then with each
+// keepalive.
+func (s *Session) RTT() time.Duration {
+	s.pingMu.Lock()
+	defer s.pingMu.Unlock()
+	return s.rtt
+}
+
+// acceptsVersion reports whether frames of the protocol version are valid in the session.
+func (s *Session) acceptsVersion(ver byte) bool {
+	return ver == byte(s.config.Version) || ver == 2 && s.localExtensions()&extStreamV2 != 0
+}
+
+// streamVersion returns the protocol version of a new stream.
+func (s *Session) streamVersion() byte {
+	if s.peerSupports(extStreamV2) {
+		return 2
+	}
+	return byte(s.config.Version)
+}
+
+// peerSupports reports whether both sides have enabled the extension. Until the peer's first
+// frame, which carries the announcement if any, it waits for at most Config.ExtensionTimeout
+// since the session started, rather than for an older peer's first keepalive.
+func (s *Session) peerSupports(ext uint32) bool {
+	if s.localExtensions()&ext == 0 {
+		return false
+	}
+	select {
+	case <-s.chPeerHello:
+		return atomic.LoadUint32(&s.peerExt)&ext != 0
+	default:
+	}
+	wait := time.Until(s.helloDeadline)
+	if wait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-s.chPeerHello:
+	case <-s.die:
+		return false
+	case <-s.chSocketReadError:
+		return false
+	case <-timer.C:
+		return false
+	}
+	return atomic.LoadUint32(&s.peerExt)&ext != 0
+}
+
+// GoAway stops opening new streams in both directions: OpenStream returns ErrGoAway, and the peer
+// is notified to do the same, so that the existing streams can finish before Close.
+func (s *Session) GoAway() error {
+	s.setGoAway()
+	_, err := s.writeFrameInternal(newFrame(byte(s.config.Version), cmdNOP, goAwayMagic), nil, CLSCTRL, nil)
+	return err
+}
+
+// GoingAway returns a channel which is closed once either side has called GoAway.
+func (s *Session) GoingAway() <-chan struct{} {
+	return s.chGoAway
+}
+
+func (s *Session) setGoAway() {
+	s.nextStreamIDLock.Lock()
+	s.goAway = 1
+	s.nextStreamIDLock.Unlock()
+	s.goAwayOnce.Do(func() {
+		close(s.chGoAway)
+	})
+}
@@ -0,0 +1,412 @@
+package smux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// oldPeer makes a session act as a peer without extension support, as released upstream: the
+// announcements are dropped in both directions, since such a peer neither sends nor reads them.
+type oldPeer struct {
+	net.Conn
+	pending []byte // Of the header being read
+	payload int    // Left of the frame being read
+}
+
+func isAnnouncement(h []byte) bool {
+	return h[1] == cmdNOP && binary.LittleEndian.Uint32(h[4:])&^extMask == extMagic
+}
+
+func (c *oldPeer) Read(p []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	if c.payload > 0 {
+		if len(p) > c.payload {
+			p = p[:c.payload]
+		}
+		n, err := c.Conn.Read(p)
+		c.payload -= n
+		return n, err
+	}
+	h := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(c.Conn, h); err != nil {
+			return 0, err
+		}
+		if !isAnnouncement(h) {
+			break
+		}
+	}
+	c.payload = int(binary.LittleEndian.Uint16(h[2:]))
+	n := copy(p, h)
+	c.pending = h[n:]
+	return n, nil
+}
+
+// Relies on the sendLoop writing a frame at a time.
+func (c *oldPeer) Write(p []byte) (int, error) {
+	if len(p) == headerSize && isAnnouncement(p) {
+		return len(p), nil
+	}
+	return c.Conn.Write(p)
+}
+
+// Returns a session pair over a pipe, either of which may act as an old peer.
+func testSessionPair(t *testing.T, oldClient, oldServer bool, config *Config) (client, server *Session) {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	if oldClient || oldServer {
+		// An old peer never announces, so peerSupports waits for the full extension timeout
+		c := *config
+		c.ExtensionTimeout = 100 * time.Millisecond
+		config = &c
+	}
+	var c1, c2 net.Conn
+	c1, c2 = net.Pipe()
+	if oldClient {
+		c1 = &oldPeer{Conn: c1}
+	}
+	if oldServer {
+		c2 = &oldPeer{Conn: c2}
+	}
+	client, err := Client(c1, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = Server(c2, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+var testPeers = []struct {
+	name                 string
+	oldClient, oldServer bool
+}{
+	{"new to new", false, false},
+	{"old to new", true, false},
+	{"new to old", false, true},
+}
+
+func TestExtNegotiation(t *testing.T) {
+	for _, p := range testPeers {
+		client, server := testSessionPair(t, p.oldClient, p.oldServer, nil)
+		expect := !p.oldClient && !p.oldServer
+		for _, ext := range []uint32{extHalfClose, extStreamMeta} {
+			if got := client.peerSupports(ext); got != expect {
+				t.Errorf("%s: client supports %#x: expected %v, got %v", p.name, ext, expect, got)
+			}
+			if got := server.peerSupports(ext); got != expect {
+				t.Errorf("%s: server supports %#x: expected %v, got %v", p.name, ext, expect, got)
+			}
+		}
+	}
+}
+
+// Opening a stream to an old peer waits for the extension timeout, not for the peer's keepalive.
+func TestOpenStreamOldPeer(t *testing.T) {
+	config := DefaultConfig()
+	config.StreamVersion = 2
+	client, server := testSessionPair(t, false, true, config)
+	go server.AcceptStream()
+	start := time.Now()
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > config.KeepAliveInterval/2 {
+		t.Fatalf("expected the open not to wait for a keepalive, took %v", took)
+	}
+	if stream.version != 1 {
+		t.Errorf("expected a version 1 stream, got %d", stream.version)
+	}
+	// Later streams don't wait at all
+	start = time.Now()
+	if _, err := client.OpenStream(); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > 50*time.Millisecond {
+		t.Errorf("expected the second open not to wait, took %v", took)
+	}
+}
+
+// A new peer's announcement arrives right away, so opens don't wait for the timeout.
+func TestOpenStreamNewPeer(t *testing.T) {
+	config := DefaultConfig()
+	config.StreamVersion = 2
+	config.ExtensionTimeout = time.Minute
+	client, server := testSessionPair(t, false, false, config)
+	go server.AcceptStream()
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.version != 2 {
+		t.Errorf("expected a version 2 stream, got %d", stream.version)
+	}
+}
+
+// Accepts a stream in the background.
+func acceptAsync(sess *Session) <-chan *Stream {
+	ch := make(chan *Stream, 1)
+	go func() {
+		stream, _ := sess.AcceptStream()
+		ch <- stream
+	}()
+	return ch
+}
+
+func TestHalfClose(t *testing.T) {
+	client, server := testSessionPair(t, false, false, nil)
+	accepted := acceptAsync(server)
+	cs, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.Write([]byte("more")); err != io.ErrClosedPipe {
+		t.Fatalf("expected ErrClosedPipe writing after CloseWrite, got %v", err)
+	}
+	if err := cs.CloseWrite(); err != io.ErrClosedPipe {
+		t.Fatalf("expected ErrClosedPipe closing twice, got %v", err)
+	}
+
+	ss := <-accepted
+	req, err := io.ReadAll(ss)
+	if err != nil || string(req) != "request" {
+		t.Fatalf("expected the request and EOF, got %q, %v", req, err)
+	}
+	// The other direction stays open
+	if _, err := ss.Write([]byte("response")); err != nil {
+		t.Fatal(err)
+	}
+	ss.Close()
+	resp, err := io.ReadAll(cs)
+	if err != nil || string(resp) != "response" {
+		t.Fatalf("expected the response and EOF, got %q, %v", resp, err)
+	}
+	cs.Close()
+}
+
+func TestHalfCloseOldPeer(t *testing.T) {
+	for _, p := range testPeers[1:] {
+		client, server := testSessionPair(t, p.oldClient, p.oldServer, nil)
+		accepted := acceptAsync(server)
+		cs, err := client.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cs.CloseWrite(); err != ErrHalfCloseUnsupported {
+			t.Fatalf("%s: expected ErrHalfCloseUnsupported, got %v", p.name, err)
+		}
+		// The stream is left unchanged, so that Close is the fallback
+		if _, err := cs.Write([]byte("request")); err != nil {
+			t.Fatalf("%s: write after CloseWrite: %v", p.name, err)
+		}
+		cs.Close()
+		req, err := io.ReadAll(<-accepted)
+		if err != nil || string(req) != "request" {
+			t.Fatalf("%s: expected the request and EOF, got %q, %v", p.name, req, err)
+		}
+	}
+}
+
+func TestStreamMeta(t *testing.T) {
+	client, server := testSessionPair(t, false, false, nil)
+	large := make([]byte, 0xffff)
+	rand.Read(large)
+	for _, meta := range [][]byte{nil, []byte("ssh"), large} {
+		accepted := acceptAsync(server)
+		cs, err := client.OpenStreamWithMeta(meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ss := <-accepted
+		if !bytes.Equal(ss.Meta(), meta) || !bytes.Equal(cs.Meta(), meta) {
+			t.Fatalf("meta of %d bytes differs", len(meta))
+		}
+		// The stream works as usual
+		cs.Write([]byte("data"))
+		cs.Close()
+		if b, _ := io.ReadAll(ss); string(b) != "data" {
+			t.Fatalf("expected data after meta, got %q", b)
+		}
+	}
+	if _, err := client.OpenStreamWithMeta(make([]byte, 0x10000)); err != ErrStreamMetaTooLarge {
+		t.Fatalf("expected ErrStreamMetaTooLarge, got %v", err)
+	}
+}
+
+func TestStreamMetaOldPeer(t *testing.T) {
+	for _, p := range testPeers[1:] {
+		client, server := testSessionPair(t, p.oldClient, p.oldServer, nil)
+		if _, err := client.OpenStreamWithMeta([]byte("ssh")); err != ErrStreamMetaUnsupported {
+			t.Fatalf("%s: expected ErrStreamMetaUnsupported, got %v", p.name, err)
+		}
+		// No stream was opened, so the next one is the first the peer accepts
+		accepted := acceptAsync(server)
+		cs, err := client.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ss := <-accepted
+		if ss.ID() != cs.ID() || ss.Meta() != nil {
+			t.Fatalf("%s: expected stream %d without meta, got %d, %q", p.name, cs.ID(), ss.ID(), ss.Meta())
+		}
+	}
+}
+
+// A config with a v1 session, whose receive buffer a single stream can exhaust, and v2 streams.
+func testStreamV2Config() *Config {
+	config := DefaultConfig()
+	config.MaxReceiveBuffer = 256 << 10
+	config.MaxStreamBuffer = 64 << 10
+	config.StreamVersion = 2
+	return config
+}
+
+func TestStreamV2InV1Session(t *testing.T) {
+	for _, p := range testPeers {
+		client, server := testSessionPair(t, p.oldClient, p.oldServer, testStreamV2Config())
+		expect := byte(2)
+		if p.oldClient || p.oldServer {
+			expect = 1
+		}
+		data := make([]byte, 1<<20)
+		rand.Read(data)
+		accepted := acceptAsync(server)
+		cs, err := client.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			cs.Write(data)
+			cs.Close()
+		}()
+		ss := <-accepted
+		if cs.version != expect || ss.version != expect {
+			t.Fatalf("%s: expected version %d streams, got %d and %d", p.name, expect, cs.version, ss.version)
+		}
+		got, err := io.ReadAll(ss)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%s: expected %d bytes, got %d, %v", p.name, len(data), len(got), err)
+		}
+	}
+}
+
+// With per-stream flow control, a stream which isn't read doesn't stall the others, whereas it
+// would exhaust the receive buffer of a v1 session.
+func TestStreamV2Stalled(t *testing.T) {
+	client, server := testSessionPair(t, false, false, testStreamV2Config())
+	accepted := acceptAsync(server)
+	stalled, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-accepted
+	go stalled.Write(make([]byte, 1<<20))
+
+	accepted = acceptAsync(server)
+	cs, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := <-accepted
+	data := make([]byte, 1<<20)
+	go func() {
+		cs.Write(data)
+		cs.Close()
+	}()
+	done := make(chan error, 1)
+	go func() {
+		got, err := io.ReadAll(ss)
+		if err == nil && len(got) != len(data) {
+			err = fmt.Errorf("expected %d bytes, got %d", len(data), len(got))
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal(errors.New("stream stalled by another"))
+	}
+}
+
+func TestPing(t *testing.T) {
+	for _, p := range testPeers {
+		config := DefaultConfig()
+		config.KeepAliveInterval = 100 * time.Millisecond
+		client, server := testSessionPair(t, p.oldClient, p.oldServer, config)
+		time.Sleep(300 * time.Millisecond)
+		expect := !p.oldClient && !p.oldServer
+		if got := client.RTT() > 0; got != expect {
+			t.Errorf("%s: expected a client rtt %v, got %v", p.name, expect, client.RTT())
+		}
+		if got := server.RTT() > 0; got != expect {
+			t.Errorf("%s: expected a server rtt %v, got %v", p.name, expect, server.RTT())
+		}
+	}
+}
+
+// A pong only counts for the latest ping.
+func TestPongSequence(t *testing.T) {
+	config := DefaultConfig()
+	config.KeepAliveDisabled = true
+	client, _ := testSessionPair(t, false, false, config)
+	// After the ping upon connecting
+	for i := 0; client.RTT() == 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	client.pingMu.Lock()
+	client.pingSeq, client.pingSent, client.rtt = 7, time.Now(), 0
+	client.pingMu.Unlock()
+	client.pong(6)
+	if rtt := client.RTT(); rtt != 0 {
+		t.Fatalf("expected no rtt from an earlier pong, got %v", rtt)
+	}
+	client.pong(7)
+	if rtt := client.RTT(); rtt <= 0 {
+		t.Fatalf("expected an rtt, got %v", rtt)
+	}
+}
+
+// A stream which fails to open isn't left registered.
+func TestOpenStreamFailed(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client, err := Client(c1, DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	c2.Close()
+	if _, err := client.OpenStream(); err == nil {
+		t.Fatal("expected an error")
+	}
+	if n := client.NumStreams(); n != 0 {
+		t.Fatalf("expected no streams, got %d", n)
+	}
+}
@@ -0,0 +1,82 @@
+package smux
+
+func _itimediff(later, earlier uint32) int32 {
+	return (int32)(later - earlier)
+}
+
+// Streams share the session in proportion to their weights, by weighted fair queueing: each
+// data frame is tagged with the virtual time at which its stream would finish sending it, and
+// frames are written in order of their tags. Virtual time advances inversely to the total weight
+// of the backlogged streams, so that a stream which starts sending, e.g. an interactive one, is
+// served ahead of frames already queued by streams of lower weight.
+type fairQueue struct {
+	vtime   uint64          // current virtual time
+	weights uint64          // total weight of the backlogged streams
+	backlog map[*Stream]int // number of queued frames by stream
+}
+
+// tag sets the virtual finish time of a data frame. Must be called once per request, when it
+// enters the shaper.
+func (q *fairQueue) tag(req *writeRequest) {
+	st := req.stream
+	if st == nil {
+		return
+	}
+	if q.backlog == nil {
+		q.backlog = make(map[*Stream]int)
+	}
+	if q.backlog[st] == 0 {
+		st.vweight = uint64(st.Weight())
+		q.weights += st.vweight
+	}
+	q.backlog[st]++
+	// A stream that has been idle starts at the current virtual time, so it can't save up credit
+	start := st.vfinish
+	if start < q.vtime {
+		start = q.vtime
+	}
+	st.vfinish = start + frameCost(req)/st.vweight
+	req.tag = st.vfinish
+}
+
+// sent advances the virtual time past a written frame.
+func (q *fairQueue) sent(req *writeRequest) {
+	st := req.stream
+	if st == nil {
+		return
+	}
+	q.vtime += frameCost(req) / q.weights
+	if q.backlog[st]--; q.backlog[st] == 0 {
+		delete(q.backlog, st)
+		q.weights -= st.vweight
+	}
+}
+
+// frameCost returns the size of the frame, scaled for division by weights.
+func frameCost(req *writeRequest) uint64 {
+	return uint64(len(req.frame.data)+headerSize) * MaxStreamWeight
+}
+
+type shaperHeap []writeRequest
+
+func (h shaperHeap) Len() int { return len(h) }
+func (h shaperHeap) Less(i, j int) bool {
+	if h[i].class != h[j].class {
+		return h[i].class < h[j].class
+	}
+	if h[i].tag != h[j].tag {
+		return h[i].tag < h[j].tag
+	}
+	return _itimediff(h[j].seq, h[i].seq) > 0
+}
+
+func (h shaperHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *shaperHeap) Push(x interface{}) { *h = append(*h, x.(writeRequest)) }
+
+func (h *shaperHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
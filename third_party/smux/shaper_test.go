@@ -0,0 +1,145 @@
+package smux
+
+import (
+	"container/heap"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func TestShaper(t *testing.T) {
+	w1 := writeRequest{seq: 1}
+	w2 := writeRequest{seq: 2}
+	w3 := writeRequest{seq: 3}
+	w4 := writeRequest{seq: 4}
+	w5 := writeRequest{seq: 5}
+
+	var reqs shaperHeap
+	heap.Push(&reqs, w5)
+	heap.Push(&reqs, w4)
+	heap.Push(&reqs, w3)
+	heap.Push(&reqs, w2)
+	heap.Push(&reqs, w1)
+
+	for len(reqs) > 0 {
+		w := heap.Pop(&reqs).(writeRequest)
+		t.Log("sid:", w.frame.sid, "seq:", w.seq)
+	}
+}
+
+func TestShaper2(t *testing.T) {
+	w1 := writeRequest{class: CLSDATA, seq: 1} // stream 0
+	w2 := writeRequest{class: CLSDATA, seq: 2}
+	w3 := writeRequest{class: CLSDATA, seq: 3}
+	w4 := writeRequest{class: CLSDATA, seq: 4}
+	w5 := writeRequest{class: CLSDATA, seq: 5}
+	w6 := writeRequest{class: CLSCTRL, seq: 6, frame: Frame{sid: 10}} // ctrl 1
+	w7 := writeRequest{class: CLSCTRL, seq: 7, frame: Frame{sid: 11}} // ctrl 2
+
+	var reqs shaperHeap
+	heap.Push(&reqs, w6)
+	heap.Push(&reqs, w5)
+	heap.Push(&reqs, w4)
+	heap.Push(&reqs, w3)
+	heap.Push(&reqs, w2)
+	heap.Push(&reqs, w1)
+	heap.Push(&reqs, w7)
+
+	for len(reqs) > 0 {
+		w := heap.Pop(&reqs).(writeRequest)
+		t.Log("sid:", w.frame.sid, "seq:", w.seq)
+	}
+}
+
+// Frames of backlogged streams are written in proportion to the weights of the streams.
+func TestFairQueueWeights(t *testing.T) {
+	light, heavy := &Stream{}, &Stream{}
+	light.SetWeight(1)
+	heavy.SetWeight(3)
+	var reqs shaperHeap
+	var fair fairQueue
+	seq := uint32(0)
+	push := func(st *Stream) {
+		seq++
+		req := writeRequest{class: CLSDATA, seq: seq, stream: st, frame: Frame{data: make([]byte, 1024)}}
+		fair.tag(&req)
+		heap.Push(&reqs, req)
+	}
+	for i := 0; i < 100; i++ {
+		push(light)
+		push(heavy)
+	}
+	count := map[*Stream]int{}
+	for i := 0; i < 40; i++ {
+		req := heap.Pop(&reqs).(writeRequest)
+		fair.sent(&req)
+		count[req.stream]++
+	}
+	if count[light] != 10 || count[heavy] != 30 {
+		t.Fatalf("expected 10 light and 30 heavy frames, got %d and %d", count[light], count[heavy])
+	}
+
+	// A stream which starts sending is served ahead of the frames already queued
+	fresh := &Stream{}
+	fresh.SetWeight(128)
+	push(fresh)
+	if req := heap.Pop(&reqs).(writeRequest); req.stream != fresh {
+		t.Fatalf("expected the frame of the new stream first")
+	}
+}
+
+// Concurrent writers share the session by the weights of their streams.
+func TestWeightedShares(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client, _ := Client(c1, nil)
+	server, _ := Server(c2, nil)
+	defer client.Close()
+	defer server.Close()
+
+	const size = 4 << 20
+	weights := []int{1, 3}
+	received := make([]int64, len(weights))
+	done := make(chan int, len(weights))
+	var writers []*Stream
+	for i, weight := range weights {
+		cs, err := client.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cs.SetWeight(weight)
+		ss, err := server.AcceptStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func(i int) {
+			buf := make([]byte, 32<<10)
+			for atomic.LoadInt64(&received[i]) < size {
+				n, err := ss.Read(buf)
+				atomic.AddInt64(&received[i], int64(n))
+				if err != nil {
+					break
+				}
+			}
+			done <- i
+		}(i)
+		writers = append(writers, cs)
+		defer cs.Close()
+	}
+	start := make(chan struct{})
+	for _, cs := range writers {
+		go func(cs *Stream) {
+			<-start
+			cs.Write(make([]byte, size))
+		}(cs)
+	}
+	close(start)
+	if first := <-done; first != 1 {
+		t.Fatalf("expected the heavy stream to finish first")
+	}
+	// About a third of the heavy stream's bytes
+	share := float64(atomic.LoadInt64(&received[0])) / size
+	if share < 0.25 || share > 0.42 {
+		t.Fatalf("expected the light stream to get about a third of the heavy one, got %.2f", share)
+	}
+	t.Logf("light stream share: %.2f", share)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How often certificate files are checked for changes.
+const certPollInterval = 10 * time.Second
+
+// certReloader serves a certificate from files, and reloads it upon SIGHUP or when
+// the files change, without restarting the server.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	go r.watch()
+	return r, nil
+}
+
+// Loads the key pair from disk. The old certificate is kept if loading fails.
+func (r *certReloader) load() error {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert, r.modTime = &cert, modTime
+	return nil
+}
+
+// Returns the latest modification time of the cert and key files.
+func (r *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Reloads upon SIGHUP or when the files have been modified. Runs forever.
+func (r *certReloader) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(certPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hup:
+		case <-ticker.C:
+			modTime, err := r.filesModTime()
+			r.mu.RLock()
+			unchanged := err == nil && modTime.Equal(r.modTime)
+			r.mu.RUnlock()
+			if unchanged || err != nil {
+				continue
+			}
+		}
+		if err := r.load(); err != nil {
+			slog.Error("tls: reload failed, keeping old certificate", "cert", r.certFile, "err", err)
+			continue
+		}
+		slog.Info("tls: certificate reloaded", "cert", r.certFile)
+	}
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Returns a server TLS config, or nil if no certificate is configured. If a client CA file
+// is provided, clients must present a certificate signed by it.
+func newServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			return nil, errors.New("client certificate auth requires a server certificate")
+		}
+		return nil, nil
+	}
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		// Upgrades to rdv require http/1.1
+		NextProtos: []string{"http/1.1"},
+		MinVersion: tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		conf.ClientCAs, err = loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+// Returns a client TLS config for the rdv server, or nil for the system defaults.
+//
+//   - caFile: PEM file of roots to use instead of the system roots
+//   - pins: comma-separated base64 SHA-256 hashes of the server's SubjectPublicKeyInfo.
+//     Without a CA file, the leaf certificate must match a pin, which is then sufficient, e.g.
+//     for self-signed certificates. With a CA file, any certificate of a verified chain may match.
+//   - certFile, keyFile: client certificate for servers that require one
+func newClientTLSConfig(caFile, pins, certFile, keyFile string) (*tls.Config, error) {
+	if caFile == "" && pins == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+	var err error
+	if caFile != "" {
+		if conf.RootCAs, err = loadCertPool(caFile); err != nil {
+			return nil, err
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	if pins == "" {
+		return conf, nil
+	}
+	pinSet := make(map[string]bool)
+	for _, pin := range strings.Split(pins, ",") {
+		pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+		if b, err := base64.StdEncoding.DecodeString(pin); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid pin [%s], expected base64 sha256", pin)
+		}
+		pinSet[pin] = true
+	}
+	if caFile == "" {
+		// The pin replaces chain verification, see VerifyConnection
+		conf.InsecureSkipVerify = true
+	}
+	matches := func(cert *x509.Certificate) bool {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		return pinSet[base64.StdEncoding.EncodeToString(sum[:])]
+	}
+	conf.VerifyConnection = func(cs tls.ConnectionState) error {
+		if caFile == "" {
+			// Unverified, so other certificates sent by the server prove nothing, whereas the
+			// handshake proves possession of the leaf key
+			if len(cs.PeerCertificates) > 0 && matches(cs.PeerCertificates[0]) {
+				return nil
+			}
+			return errors.New("rdv server certificate matches no pin")
+		}
+		for _, chain := range cs.VerifiedChains {
+			if slices.ContainsFunc(chain, matches) {
+				return nil
+			}
+		}
+		return errors.New("rdv server certificate chain matches no pin")
+	}
+	return conf, nil
+}
+
+// Loads a pool of PEM certificates from a file.
+func loadCertPool(name string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", name)
+	}
+	return pool, nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// Generates a certificate for 127.0.0.1, signed by the parent, or self-signed if nil.
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert, key, der}
+}
+
+func (c *testCert) pin() string {
+	sum := sha256.Sum256(c.cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Writes the PEM chain of the certificate and its key, and returns the file names.
+func writeTestCert(t *testing.T, dir string, c *testCert, chain ...*testCert) (certFile, keyFile string) {
+	var certPEM []byte
+	for _, cc := range append([]*testCert{c}, chain...) {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cc.der})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// Serves TLS with the config on loopback, and returns the addr.
+func serveTestTLS(t *testing.T, conf *tls.Config) string {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c.(*tls.Conn).Handshake()
+				c.Close()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func testHandshake(addr string, conf *tls.Config) error {
+	c, err := tls.Dial("tcp", addr, conf)
+	if err == nil {
+		c.Close()
+	}
+	return err
+}
+
+// Returns the server's verdict on the client certificate. With TLS 1.3 the server rejects it
+// after the client has finished the handshake, so the alert arrives with the first read, whereas
+// an accepted client reads EOF as the test server closes.
+func testClientAuth(addr string, conf *tls.Config) error {
+	c, err := tls.Dial("tcp", addr, conf)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+func TestClientTLSPins(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	leaf := newTestCert(t, "leaf", ca)
+	other := newTestCert(t, "other", nil)
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, leaf, ca)
+	serverConf, err := newServerTLSConfig(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTestTLS(t, serverConf)
+	caFile := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.der}), 0600)
+	otherCAFile := filepath.Join(dir, "other.pem")
+	os.WriteFile(otherCAFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: other.der}), 0600)
+
+	for _, c := range []struct {
+		name, caFile, pins string
+		ok                 bool
+	}{
+		{"no pin, ca", caFile, "", true},
+		{"no pin, other ca", otherCAFile, "", false},
+		{"leaf pin", "", leaf.pin(), true},
+		{"leaf pin with prefix", "", "sha256/" + leaf.pin(), true},
+		{"one of the pins", "", other.pin() + ", " + leaf.pin(), true},
+		{"wrong pin", "", other.pin(), false},
+		// Without a CA, the rest of the chain is unverified, so it can't match
+		{"ca pin", "", ca.pin(), false},
+		{"leaf pin, ca", caFile, leaf.pin(), true},
+		{"ca pin, ca", caFile, ca.pin(), true},
+		{"wrong pin, ca", caFile, other.pin(), false},
+		{"leaf pin, other ca", otherCAFile, leaf.pin(), false},
+	} {
+		conf, err := newClientTLSConfig(c.caFile, c.pins, "", "")
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if err := testHandshake(addr, conf); (err == nil) != c.ok {
+			t.Errorf("%s: expected ok %v, got %v", c.name, c.ok, err)
+		}
+	}
+
+	for _, pins := range []string{"abc", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := newClientTLSConfig("", pins, "", ""); err == nil {
+			t.Errorf("%q: expected an invalid pin", pins)
+		}
+	}
+	if conf, err := newClientTLSConfig("", "", "", ""); conf != nil || err != nil {
+		t.Errorf("expected the system defaults, got %v, %v", conf, err)
+	}
+}
+
+// A client certificate is required once the server has a client CA.
+func TestClientTLSCert(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	leaf := newTestCert(t, "leaf", ca)
+	client := newTestCert(t, "client", ca)
+	stranger := newTestCert(t, "stranger", nil)
+	serverDir, clientDir := t.TempDir(), t.TempDir()
+	certFile, keyFile := writeTestCert(t, serverDir, leaf)
+	caFile := filepath.Join(serverDir, "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.der}), 0600)
+	serverConf, err := newServerTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTestTLS(t, serverConf)
+
+	conf, _ := newClientTLSConfig(caFile, "", "", "")
+	if err := testClientAuth(addr, conf); err == nil {
+		t.Errorf("expected no client cert to be rejected")
+	}
+	strangerCert, strangerKey := writeTestCert(t, t.TempDir(), stranger)
+	conf, _ = newClientTLSConfig(caFile, "", strangerCert, strangerKey)
+	if err := testClientAuth(addr, conf); err == nil {
+		t.Errorf("expected a client cert of another CA to be rejected")
+	}
+	clientCert, clientKey := writeTestCert(t, clientDir, client)
+	conf, err = newClientTLSConfig(caFile, "", clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testClientAuth(addr, conf); err != nil {
+		t.Errorf("expected the client cert to be accepted, got %v", err)
+	}
+
+	if _, err := newServerTLSConfig("", "", caFile); err == nil {
+		t.Errorf("expected a client CA without a server cert to fail")
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	first, second := newTestCert(t, "first", nil), newTestCert(t, "second", nil)
+	certFile, keyFile := writeTestCert(t, dir, first)
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		t.Fatal(err)
+	}
+	served := func() string {
+		cert, _ := r.GetCertificate(nil)
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		return leaf.Subject.CommonName
+	}
+	if got := served(); got != "first" {
+		t.Fatalf("expected the first cert, got %s", got)
+	}
+
+	// Swap the files, with a later mod time, as the watcher compares them
+	writeTestCert(t, dir, second)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	modTime, err := r.filesModTime()
+	if err != nil || modTime.Equal(r.modTime) {
+		t.Fatalf("expected a changed mod time, got %v, %v", modTime, err)
+	}
+	if err := r.load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := served(); got != "second" {
+		t.Fatalf("expected the second cert, got %s", got)
+	}
+
+	// A broken key pair keeps the old cert
+	os.WriteFile(keyFile, []byte("broken"), 0600)
+	if err := r.load(); err == nil {
+		t.Fatal("expected the broken key to fail")
+	}
+	if got := served(); got != "second" {
+		t.Fatalf("expected the second cert to be kept, got %s", got)
+	}
+}
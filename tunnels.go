@@ -0,0 +1,302 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// A tunnel forwards conns from a local listener on the accept side to a target on the dial side.
+// Both sides must use the same names and sessions, whereas each side only needs its own addr.
+type tunnel struct {
+	Name     string      `json:"name"`
+	Listen   listenAddrs `json:"listen,omitempty"`   // Local addrs, accept side
+	Target   string      `json:"target,omitempty"`   // Target addr, dial side
+	Session  string      `json:"session,omitempty"`  // Tunnels with the same session share it, defaults to the name
+	Weight   int         `json:"weight,omitempty"`   // Share of the session under load, see smux.Stream.SetWeight
+	Compress string      `json:"compress,omitempty"` // Compression of streams opened by the accept side, 'none' or 'deflate'
+	Mode     string      `json:"mode,omitempty"`     // Octal permissions of a unix socket listener, e.g. '0660'
+	Allow    []string    `json:"allow,omitempty"`    // Source CIDRs which may connect to the listeners, defaults to -allow
+	Deny     []string    `json:"deny,omitempty"`     // Source CIDRs which may not, defaults to -deny
+	Proxy    string      `json:"proxy,omitempty"`    // PROXY protocol header sent to the target, 'none', 'v1' or 'v2'
+
+	// Limits of the forwarded conns, as durations such as '5m', or '0' to disable. Each side
+	// enforces its own, and defaults to -fwd-idle, -fwd-max-life and -keepalive.
+	Idle        string `json:"idle,omitempty"`         // Without traffic in either direction
+	MaxLifetime string `json:"max_lifetime,omitempty"` // Since accepted
+	KeepAlive   string `json:"keepalive,omitempty"`    // Tcp keepalive period of local and target conns
+
+	src acl
+}
+
+// The local addrs of a tunnel, given as a string or a list of strings in json. Each may have a
+// network prefix, see parseEndpoint.
+type listenAddrs []string
+
+func (a *listenAddrs) UnmarshalJSON(b []byte) error {
+	var addr string
+	if err := json.Unmarshal(b, &addr); err == nil {
+		*a = listenAddrs{addr}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+type tunnelConfig struct {
+	Tunnels []*tunnel `json:"tunnels"`
+}
+
+// A group of tunnels which share a session with the peer, under its own token. The session may
+// be striped across a pool of rdv conns, each with its own smux session, to avoid head-of-line
+// blocking and the throughput limit of a single tcp conn.
+type sessionGroup struct {
+	name  string
+	token string
+
+	mu      sync.Mutex
+	tunnels []*tunnel // Replaced by a reload, see clientRun.reload
+
+	members []atomic.Pointer[smux.Session] // Current session of each pooled conn, if connected
+	status  []memberStatus                 // State of each pooled conn, see clientRun.status
+	stdio   bool                           // The last member serves stdio runs, see stdioToken
+	stop    context.CancelFunc             // Stops reconnecting, see clientRun.startGroup
+}
+
+// Reads and validates a json tunnel config file. See checkEndpoints for the addrs.
+func loadTunnels(path string) ([]*tunnel, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var conf tunnelConfig
+	if err := json.Unmarshal(b, &conf); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(conf.Tunnels) == 0 {
+		return nil, fmt.Errorf("%s: no tunnels", path)
+	}
+	names := make(map[string]bool)
+	for _, t := range conf.Tunnels {
+		switch {
+		case t.Name == "":
+			return nil, errors.New("tunnel without name")
+		case names[t.Name]:
+			return nil, fmt.Errorf("duplicate tunnel [%s]", t.Name)
+		case t.Mode != "" && !slices.ContainsFunc(t.Listen, isUnixEndpoint):
+			return nil, fmt.Errorf("tunnel [%s] has a mode but doesn't listen on a unix socket", t.Name)
+		case !validCompression(t.Compress):
+			return nil, fmt.Errorf("tunnel [%s] has unknown compression [%s]", t.Name, t.Compress)
+		case !validProxyHeader(t.Proxy):
+			return nil, fmt.Errorf("tunnel [%s] has unknown proxy header [%s]", t.Name, t.Proxy)
+		case t.Weight < 0 || t.Weight > smux.MaxStreamWeight:
+			return nil, fmt.Errorf("tunnel [%s] weight must be within [0, %d]", t.Name, smux.MaxStreamWeight)
+		}
+		for _, d := range []string{t.Idle, t.MaxLifetime, t.KeepAlive} {
+			if _, err := time.ParseDuration(cmp.Or(d, "0")); err != nil {
+				return nil, fmt.Errorf("tunnel [%s] has invalid duration [%s]", t.Name, d)
+			}
+		}
+		if _, err := parseSocketMode(t.Mode); err != nil {
+			return nil, fmt.Errorf("tunnel [%s]: %w", t.Name, err)
+		}
+		names[t.Name] = true
+	}
+	return conf.Tunnels, nil
+}
+
+// Checks that the tunnels have the addrs used by the accept or dial side.
+func checkEndpoints(tunnels []*tunnel, accept bool) error {
+	for _, t := range tunnels {
+		if accept && (len(t.Listen) == 0 || slices.Contains(t.Listen, "")) {
+			return fmt.Errorf("tunnel [%s] without listen addr", t.Name)
+		} else if !accept && t.Target == "" {
+			return fmt.Errorf("tunnel [%s] without target addr", t.Name)
+		} else if network, _ := parseEndpoint(t.Target); !accept && network == "systemd" {
+			return fmt.Errorf("tunnel [%s] can't dial a systemd socket", t.Name)
+		}
+	}
+	return nil
+}
+
+// Returns the PROXY protocol version sent to the tunnel's target, "" for none.
+func (t *tunnel) proxyHeader() string {
+	if p := cmp.Or(t.Proxy, flagTargetProxy); p != proxyNone {
+		return p
+	}
+	return ""
+}
+
+func (t *tunnel) idleTimeout() time.Duration {
+	return tunnelDuration(t.Idle, flagFwdIdle)
+}
+
+func (t *tunnel) maxLifetime() time.Duration {
+	return tunnelDuration(t.MaxLifetime, flagFwdMaxLife)
+}
+
+// Returns when a conn accepted at the time reaches the max lifetime, or zero if unlimited.
+func (t *tunnel) lifetimeEnd(accepted time.Time) time.Time {
+	if d := t.maxLifetime(); d > 0 {
+		return accepted.Add(d)
+	}
+	return time.Time{}
+}
+
+func (t *tunnel) keepAlive() time.Duration {
+	return tunnelDuration(t.KeepAlive, flagKeepAlive)
+}
+
+// Returns a duration of a tunnel, validated by loadTunnels, or else the default.
+func tunnelDuration(s string, def time.Duration) time.Duration {
+	if s == "" {
+		return def
+	}
+	d, _ := time.ParseDuration(s)
+	return d
+}
+
+func validProxyHeader(p string) bool {
+	return p == "" || p == proxyNone || p == proxyV1 || p == proxyV2
+}
+
+func isUnixEndpoint(addr string) bool {
+	return strings.HasPrefix(addr, unixPrefix)
+}
+
+// Returns the tunnels of comma-separated -l or -r addrs. Each gets its own session, named by
+// index, as in earlier versions.
+func legacyTunnels(addrs string, accept bool) []*tunnel {
+	var tunnels []*tunnel
+	for i, addr := range strings.Split(addrs, ",") {
+		t := &tunnel{Name: strconv.Itoa(i)}
+		if accept {
+			t.Listen = listenAddrs{addr}
+		} else {
+			t.Target = addr
+		}
+		tunnels = append(tunnels, t)
+	}
+	return tunnels
+}
+
+// Groups the tunnels by session, in order of appearance. Sessions use the token suffixed with the
+// session name, and a pool of the given size, plus a member for stdio runs if stdio is set.
+func groupTunnels(tunnels []*tunnel, token string, pool int, stdio bool) []*sessionGroup {
+	if stdio {
+		pool++
+	}
+	var groups []*sessionGroup
+	for _, t := range tunnels {
+		name := cmp.Or(t.Session, t.Name)
+		i := slices.IndexFunc(groups, func(g *sessionGroup) bool { return g.name == name })
+		if i < 0 {
+			i = len(groups)
+			groups = append(groups, &sessionGroup{
+				name:    name,
+				token:   token + ":" + name,
+				members: make([]atomic.Pointer[smux.Session], pool),
+				status:  newMemberStatus(pool),
+				stdio:   stdio,
+			})
+		}
+		groups[i].tunnels = append(groups[i].tunnels, t)
+	}
+	return groups
+}
+
+// Returns the group and tunnel with the name, or nil if not found.
+func findTunnel(groups []*sessionGroup, name string) (*sessionGroup, *tunnel) {
+	for _, g := range groups {
+		for _, t := range g.tunnelList() {
+			if t.Name == name {
+				return g, t
+			}
+		}
+	}
+	return nil, nil
+}
+
+// Returns the token of a pooled conn. The first uses the group token, as without a pool.
+func (g *sessionGroup) memberToken(i int) string {
+	switch {
+	case g.isStdio(i):
+		return g.stdioToken()
+	case i == 0:
+		return g.token
+	}
+	return fmt.Sprintf("%s/%d", g.token, i)
+}
+
+// Returns the token of stdio runs, which the dial side serves with an extra member. It differs
+// from the tokens of the pool, so that stdio runs and an accept side don't replace each other.
+func (g *sessionGroup) stdioToken() string {
+	return g.token + "/stdio"
+}
+
+func (g *sessionGroup) isStdio(i int) bool {
+	return g.stdio && i == len(g.members)-1
+}
+
+// Returns the connected session with the fewest streams, or nil if none. Sessions going away
+// are skipped, since they can't open streams.
+func (g *sessionGroup) session() *smux.Session {
+	var best *smux.Session
+	for i := range g.members {
+		sess := g.members[i].Load()
+		if sess == nil || sess.IsClosed() || goingAway(sess) {
+			continue
+		}
+		if best == nil || sess.NumStreams() < best.NumStreams() {
+			best = sess
+		}
+	}
+	return best
+}
+
+func goingAway(sess *smux.Session) bool {
+	select {
+	case <-sess.GoingAway():
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns the tunnel of a stream by name, or nil if not found. Streams from older peers have no
+// name, which is only unambiguous for a session with a single tunnel.
+func (g *sessionGroup) tunnel(name string) *tunnel {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if name == "" && len(g.tunnels) == 1 {
+		return g.tunnels[0]
+	}
+	for _, t := range g.tunnels {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+func (g *sessionGroup) tunnelList() []*tunnel {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.tunnels
+}
+
+func (g *sessionGroup) setTunnels(tunnels []*tunnel) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.tunnels = tunnels
+}